@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// visitor is someone accessing the notes.
+type visitor struct {
+	user    string // Empty if not logged in
+	trusted bool   // Authentication is disabled, so everything is accessible
+}
+
+// requestVisitor returns the visitor making the request.
+func requestVisitor(r *http.Request) visitor {
+	return visitor{requestUser(r), users == nil}
+}
+
+// headerList splits a comma-separated header value.
+func headerList(value string) (list []string) {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether the visitor may read the document, or edit it if edit
+// is set. Access is controlled with the headers `visibility: private`, which hides
+// the document from visitors who aren't logged in, and `readers` and `editors`,
+// which list the users allowed to read and edit it. Editors may also read the
+// document. The restrictions of a host apply to all documents below it. If the
+// slug of the host is contested, the restrictions of all documents with the slug
+// apply, because it isn't known which of them was meant.
+func (v visitor) allowed(documents map[string]document, doc document, edit bool) bool {
+	if v.trusted {
+		return true
+	}
+	visited := map[string]bool{doc.slug: true}
+	pending := []document{doc}
+	for len(pending) != 0 {
+		doc := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		readers := headerList(doc.headers["readers"])
+		editors := headerList(doc.headers["editors"])
+		if doc.headers["visibility"] == "private" && v.user == "" {
+			return false
+		}
+		if len(readers) != 0 && !contains(readers, v.user) && !contains(editors, v.user) {
+			return false
+		}
+		if edit && len(editors) != 0 && !contains(editors, v.user) {
+			return false
+		}
+
+		if (doc.slug == "" && doc.host == "") || visited[doc.host] {
+			continue // Root or cycle of hosts
+		}
+		visited[doc.host] = true
+		host, ok := documents[doc.host]
+		if !ok {
+			host = document{slug: doc.host}
+		}
+		pending = append(pending, host)
+		for _, claimant := range host.claimants {
+			if !visited[claimant] {
+				visited[claimant] = true
+				pending = append(pending, documents[claimant])
+			}
+		}
+	}
+	return true
+}
+
+// canRead reports whether the visitor may read the document with the given slug.
+func (v visitor) canRead(documents map[string]document, slug string) bool {
+	return v.allowed(documents, documents[slug], false)
+}
+
+// requireAccess rejects the request if the visitor may not read, or edit if edit
+// is set, the document with the given id. Deleted documents are checked using
+// their last revision.
+func requireAccess(r *http.Request, id string, edit bool) {
+	v := requestVisitor(r)
+	if v.trusted {
+		return
+	}
+	doc, ok := docIndex.byId(id)
+	if !ok {
+		if history, err := docs.FileHistory(id); err == nil && len(history) != 0 {
+			if body, ok := readRevision(id, history[0]); ok {
+				doc = parseFile(docFile{id, body})
+			}
+		}
+	}
+	requireAllowed(v, doc, edit)
+}
+
+// allows reports whether the visitor may access the document,
+// which doesn't need to be in the index.
+func (idx *documentIndex) allows(v visitor, doc document, edit bool) bool {
+	idx.RLock()
+	defer idx.RUnlock()
+	return v.allowed(idx.documents, doc, edit)
+}
+
+// readable returns the slugs of the documents which the visitor may read.
+func (idx *documentIndex) readable(v visitor, slugs []string) []string {
+	idx.RLock()
+	defer idx.RUnlock()
+	var result []string
+	for _, slug := range slugs {
+		if v.canRead(idx.documents, slug) {
+			result = append(result, slug)
+		}
+	}
+	return result
+}
+
+// requireAllowed rejects the request if the visitor may not access the document.
+func requireAllowed(v visitor, doc document, edit bool) {
+	if !docIndex.allows(v, doc, edit) {
+		panic(appError{Description: "You don't have access to this note", Status: http.StatusForbidden})
+	}
+}
+
+// requireHostAccess rejects the request if the visitor
+// may not add documents below the given host.
+func requireHostAccess(r *http.Request, host string) {
+	v := requestVisitor(r)
+	if v.trusted {
+		return
+	}
+	docIndex.RLock()
+	doc, ok := docIndex.documents[host]
+	docIndex.RUnlock()
+	if !ok {
+		doc = document{slug: host}
+	}
+	requireAllowed(v, doc, true)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func useUsers(t *testing.T, names ...string) {
+	users = make(map[string][]byte)
+	for _, name := range names {
+		users[name] = nil
+	}
+	t.Cleanup(func() { users = nil })
+}
+
+func TestDeleteRehostsOnlyEditableChildren(t *testing.T) {
+	useTemporaryStore(t)
+	useUsers(t, "alice", "bob")
+	writeRevision(docFile{"p", ":parent Parent\n\n"}, "", "")
+	writeRevision(docFile{"m", "parent:mine Mine\n\n"}, "", "")
+	writeRevision(docFile{"b", "parent:bobs Bob's\neditors: bob\n\n"}, "", "")
+
+	deleteDocument("p", true, visitor{user: "alice"})
+	if f, _ := docIndex.file("m"); !strings.HasPrefix(f.Body, ":mine ") {
+		t.Errorf("editable child wasn't moved: %q", f.Body)
+	}
+	if f, _ := docIndex.file("b"); !strings.HasPrefix(f.Body, "parent:bobs ") {
+		t.Errorf("child of another editor was moved: %q", f.Body)
+	}
+}
+
+func TestRedirectNoteIdChecksAccess(t *testing.T) {
+	useTemporaryStore(t)
+	useUsers(t, "alice")
+	writeRevision(docFile{"s", ":secret Secret\nvisibility: private\n\n"}, "", "")
+
+	for _, id := range []string{"s", "/s"} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.URL.Path = id // As left by StripPrefix
+		w := httptest.NewRecorder()
+		errorHandler(redirectNoteId()).ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden || strings.Contains(w.Header().Get("Location"), "secret") {
+			t.Errorf("%s: private note was revealed: %d %q", id, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
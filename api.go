@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/atmatto/atylar"
+)
+
+// apiDocument is the representation of a document used by the API.
+type apiDocument struct {
+	Id         string            `json:"id"`
+	Host       string            `json:"host"`
+	Slug       string            `json:"slug"`
+	Title      string            `json:"title"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Content    string            `json:"content,omitempty"`
+	Children   []string          `json:"children,omitempty"`
+	Generation uint64            `json:"generation,omitempty"` // Set only for historic versions
+}
+
+func newApiDocument(doc document, withContent bool) apiDocument {
+	d := apiDocument{
+		Id:       doc.id,
+		Host:     doc.host,
+		Slug:     doc.slug,
+		Title:    doc.title,
+		Children: doc.children,
+	}
+	if withContent {
+		d.Headers = doc.headers
+		d.Content = doc.content
+	}
+	return d
+}
+
+// apiErrorHandler does error reporting for the API. Errors are
+// reported as JSON objects instead of HTML pages.
+func apiErrorHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered != nil {
+				log.Println("api error ("+log.Prefix()+"; "+r.URL.String()+"):", recovered)
+				err, ok := recovered.(appError)
+				if !ok {
+					err.Err = recovered.(error)
+					err.Description = "Unknown error"
+				}
+				status := http.StatusInternalServerError
+				if err.Status != 0 {
+					status = err.Status
+				}
+				writeJSON(w, status, struct {
+					Error string `json:"error"`
+				}{err.Error()})
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("api error: failed to encode response:", err)
+	}
+}
+
+// readDocFile decodes a docFile sent in the request body.
+func readDocFile(r *http.Request) docFile {
+	var f docFile
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		panic(appError{Err: err, Description: "Failed to parse request body", Status: http.StatusBadRequest})
+	}
+	return f
+}
+
+// documentExists checks whether a file with the given id is present in the store.
+func documentExists(id string) bool {
+	_, err := docs.Stat(id, false)
+	if errors.Is(err, atylar.ErrIllegalPath) {
+		panic(appError{Err: err, Description: "Illegal document id", Status: http.StatusBadRequest})
+	} else if errors.Is(err, os.ErrNotExist) {
+		return false
+	} else if err != nil {
+		panic(appError{Err: err, Description: "Failed to access document"})
+	}
+	return true
+}
+
+// documentETag returns the entity tag identifying the current version of the document.
+func documentETag(id string) string {
+	return `"` + currentToken(id) + `"`
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	panic(appError{Description: "Unsupported HTTP method", Status: http.StatusMethodNotAllowed})
+}
+
+// serveAPI handles the following routes:
+//
+//	GET    /documents                   list documents
+//	POST   /documents                   create a document from a docFile
+//	GET    /documents/{id}              get a document
+//	PUT    /documents/{id}              replace a document with a docFile (an
+//	                                    If-Match header with the ETag from GET
+//	                                    makes it fail with 409 if it changed)
+//	DELETE /documents/{id}              delete a document (?children=rehost
+//	                                    moves its children to its host)
+//	GET    /documents/{id}/history      list generations of a document
+//	GET    /documents/{id}/history/{g}  get a historic version of a document
+func serveAPI() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimSuffix(r.URL.Path, "/")
+		if path == "/documents" {
+			switch r.Method {
+			case http.MethodGet:
+				apiListDocuments(w, requestVisitor(r))
+			case http.MethodPost:
+				requireWritable()
+				f := readDocFile(r)
+				requireHostAccess(r, parseFile(f).host)
+				apiCreateDocument(w, f, requestUser(r))
+			default:
+				methodNotAllowed(w, http.MethodGet, http.MethodPost)
+			}
+			return
+		}
+		if !strings.HasPrefix(path, "/documents/") {
+			panic(appError{Description: "Not found", Status: http.StatusNotFound})
+		}
+		id := strings.TrimPrefix(path, "/documents/")
+
+		// Identifiers may contain slashes, so the history suffix is searched from the end.
+		if i := strings.LastIndex(id, "/history"); i != -1 {
+			generation := strings.TrimPrefix(id[i:], "/history")
+			if generation == "" || generation[0] == '/' {
+				if r.Method != http.MethodGet {
+					methodNotAllowed(w, http.MethodGet)
+				}
+				id = id[:i]
+				requireAccess(r, id, false)
+				if generation == "" {
+					apiListHistory(w, id)
+				} else {
+					g, err := strconv.ParseUint(generation[1:], 10, 64)
+					if err != nil || g == 0 {
+						panic(appError{Err: err, Description: "Invalid generation", Status: http.StatusBadRequest})
+					}
+					apiGetGeneration(w, id, g)
+				}
+				return
+			}
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			doc, ok := docIndex.byId(id)
+			if !ok {
+				panic(appError{Description: "Document does not exist: " + id, Status: http.StatusNotFound})
+			}
+			v := requestVisitor(r)
+			requireAllowed(v, doc, false)
+			doc.children = docIndex.readable(v, doc.children)
+			w.Header().Set("ETag", documentETag(id))
+			writeJSON(w, http.StatusOK, newApiDocument(doc, true))
+		case http.MethodPut:
+			requireWritable()
+			f := readDocFile(r)
+			if f.Id != "" && f.Id != id {
+				panic(appError{Description: "Document id in the body differs from the URL", Status: http.StatusBadRequest})
+			}
+			if !documentExists(id) {
+				panic(appError{Description: "Document does not exist: " + id, Status: http.StatusNotFound})
+			}
+			requireAccess(r, id, true)
+			f.Id = id
+			requireHostAccess(r, parseFile(f).host)
+			defer lockDocument(id)()
+			if match := r.Header.Get("If-Match"); match != "" && match != "*" && match != documentETag(id) {
+				panic(appError{Description: "Document was changed since it was retrieved: " + id, Status: http.StatusConflict})
+			}
+			writeRevision(f, requestUser(r), "")
+			w.Header().Set("ETag", documentETag(id))
+			doc, _ := docIndex.byId(id)
+			writeJSON(w, http.StatusOK, newApiDocument(doc, true))
+		case http.MethodDelete:
+			requireWritable()
+			if !documentExists(id) {
+				panic(appError{Description: "Document does not exist: " + id, Status: http.StatusNotFound})
+			}
+			requireAccess(r, id, true)
+			deleteDocument(id, r.URL.Query().Get("children") == "rehost", requestVisitor(r))
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+		}
+	})
+}
+
+func apiListDocuments(w http.ResponseWriter, v visitor) {
+	docIndex.RLock()
+	list := make([]apiDocument, 0, len(docIndex.slugs))
+	for _, slug := range docIndex.slugs {
+		doc := docIndex.documents[slug]
+		if !v.allowed(docIndex.documents, doc, false) {
+			continue
+		}
+		doc.children = nil
+		list = append(list, newApiDocument(doc, false))
+	}
+	docIndex.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Slug < list[j].Slug })
+	writeJSON(w, http.StatusOK, list)
+}
+
+func apiCreateDocument(w http.ResponseWriter, f docFile, author string) {
+	if f.Id == "" {
+		f.Id = newDocumentId()
+	} else if documentExists(f.Id) {
+		panic(appError{Description: "Document already exists: " + f.Id, Status: http.StatusConflict})
+	}
+	writeRevision(f, author, "")
+	doc, _ := docIndex.byId(f.Id)
+	w.Header().Set("Location", appPath("/api/documents/"+f.Id))
+	writeJSON(w, http.StatusCreated, newApiDocument(doc, true))
+}
+
+func apiListHistory(w http.ResponseWriter, id string) {
+	generations, err := docs.FileHistory(id)
+	if errors.Is(err, os.ErrNotExist) {
+		generations = nil
+	} else if err != nil {
+		panic(appError{Err: err, Description: "Couldn't load document's revision list"})
+	}
+	if len(generations) == 0 && !documentExists(id) {
+		panic(appError{Description: "Document does not exist: " + id, Status: http.StatusNotFound})
+	}
+	if generations == nil {
+		generations = []uint64{}
+	}
+	writeJSON(w, http.StatusOK, generations)
+}
+
+func apiGetGeneration(w http.ResponseWriter, id string, generation uint64) {
+	f, err := docs.Open(id, generation)
+	if errors.Is(err, os.ErrNotExist) {
+		panic(appError{Description: "Revision does not exist", Status: http.StatusNotFound})
+	} else if err != nil {
+		panic(appError{Err: err, Description: "Failed to open document"})
+	}
+	defer f.Close()
+	bytes, err := io.ReadAll(f)
+	if err != nil {
+		panic(appError{Err: err, Description: "Failed to read file"})
+	}
+	d := newApiDocument(parseFile(docFile{id, string(bytes)}), true)
+	d.Generation = generation
+	writeJSON(w, http.StatusOK, d)
+}
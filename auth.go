@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	sessionCookie   = "manesei_session"
+	sessionDuration = 30 * 24 * time.Hour
+)
+
+// users maps user names to bcrypt password hashes. If it's
+// nil, authentication is disabled and everyone has access.
+var users map[string][]byte
+
+type session struct {
+	user    string
+	expires time.Time
+}
+
+// sessions are kept in memory, so they end when the server is restarted.
+var sessions = struct {
+	sync.Mutex
+	tokens map[string]session
+}{tokens: make(map[string]session)}
+
+type userKey struct{}
+
+// loadUsers reads the users file, in which every line has the form
+// `name:hash`. Empty lines and lines starting with # are ignored.
+func loadUsers(file string) (map[string][]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, hash, ok := strings.Cut(text, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s:%d: expected name:hash", file, line)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid password hash of %s: %v", file, line, name, err)
+		}
+		users[name] = []byte(hash)
+	}
+	return users, scanner.Err()
+}
+
+// addUser adds a user to the users file or changes the password of an
+// existing one. The password is read from the first line of the standard input.
+func addUser(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: adduser NAME")
+	}
+	name := args[0]
+	if name == "" || strings.ContainsAny(name, ":\n") {
+		return errors.New("user names can't be empty or contain colons")
+	}
+	if config.users == "" {
+		return errors.New("no users file, set it with -users or MANESEI_USERS")
+	}
+	existing, err := loadUsers(config.users)
+	if errors.Is(err, os.ErrNotExist) {
+		existing = make(map[string][]byte)
+	} else if err != nil {
+		return err
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	password = strings.TrimSuffix(strings.TrimSuffix(password, "\n"), "\r")
+	if password == "" {
+		return errors.New("the password can't be empty")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	existing[name] = hash
+
+	names := make([]string, 0, len(existing))
+	for n := range existing {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var content strings.Builder
+	for _, n := range names {
+		content.WriteString(n + ":" + string(existing[n]) + "\n")
+	}
+	if err := os.WriteFile(config.users, []byte(content.String()), 0600); err != nil {
+		return err
+	}
+	fmt.Println("Saved user", name)
+	return nil
+}
+
+// checkPassword reports whether the password is correct for the user.
+func checkPassword(name, password string) bool {
+	hash, ok := users[name]
+	if !ok {
+		// Compare anyway, so that the time doesn't reveal which users exist.
+		hash = []byte("$2a$10$fqzTfkuiD8aeDORiO6msxOcPkWPvTs7rEnZnvYSXOvmMvuvaON6W.")
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil && ok
+}
+
+// newSession starts a session of the user and returns its token.
+func newSession(name string) string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(appError{Err: err, Description: "Failed to create session"})
+	}
+	token := hex.EncodeToString(b)
+	sessions.Lock()
+	defer sessions.Unlock()
+	now := time.Now()
+	for t, s := range sessions.tokens {
+		if now.After(s.expires) {
+			delete(sessions.tokens, t)
+		}
+	}
+	sessions.tokens[token] = session{name, now.Add(sessionDuration)}
+	return token
+}
+
+// sessionUser returns the user who is logged in with the request.
+// API clients may use basic authentication instead of a session cookie.
+func sessionUser(r *http.Request) (string, bool) {
+	if name, password, ok := r.BasicAuth(); ok {
+		return name, checkPassword(name, password)
+	}
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", false
+	}
+	sessions.Lock()
+	defer sessions.Unlock()
+	s, ok := sessions.tokens[cookie.Value]
+	if !ok || time.Now().After(s.expires) {
+		return "", false
+	}
+	return s.user, true
+}
+
+// requestUser returns the name of the user making the request,
+// or an empty string if authentication is disabled.
+func requestUser(r *http.Request) string {
+	name, _ := r.Context().Value(userKey{}).(string)
+	return name
+}
+
+// authenticated allows only logged in users to access the handler.
+// Other visitors are redirected to the login page.
+func authenticated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if users == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name, ok := sessionUser(r)
+		if !ok {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				panic(appError{Description: "You need to log in", Status: http.StatusUnauthorized})
+			}
+			http.Redirect(w, r, appPath("/login?next=")+template.URLQueryEscaper(r.RequestURI), http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, name)))
+	})
+}
+
+// apiAuthenticated is like authenticated, but responds
+// with an error instead of redirecting to the login page.
+func apiAuthenticated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if users == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name, ok := sessionUser(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="manesei"`)
+			panic(appError{Description: "You need to log in", Status: http.StatusUnauthorized})
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, name)))
+	})
+}
+
+// public allows everyone to access the handler if the notes are public.
+// Logged in users are still recognized.
+func public(next http.Handler) http.Handler {
+	if !config.public {
+		return authenticated(next)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if name, ok := sessionUser(r); ok {
+			r = r.WithContext(context.WithValue(r.Context(), userKey{}, name))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func serveLogin() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next := r.FormValue("next")
+		// Only redirect within the application.
+		if !strings.HasPrefix(next, appPath("/")) || strings.HasPrefix(next, "//") || strings.Contains(next, "\\") {
+			next = appPath("/n/")
+		}
+		message := ""
+		if r.Method == http.MethodPost {
+			name := r.PostFormValue("name")
+			if checkPassword(name, r.PostFormValue("password")) {
+				http.SetCookie(w, &http.Cookie{
+					Name:     sessionCookie,
+					Value:    newSession(name),
+					Path:     appPath("/"),
+					MaxAge:   int(sessionDuration / time.Second),
+					HttpOnly: true,
+					SameSite: http.SameSiteLaxMode,
+				})
+				http.Redirect(w, r, next, http.StatusSeeOther)
+				return
+			}
+			message = "Wrong user name or password."
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+
+		var pageBuilder strings.Builder
+		err := templates.ExecuteTemplate(&pageBuilder, "login.html", struct {
+			Next    string
+			Message string
+		}{next, message})
+		if err != nil {
+			panic(appError{Err: err, Description: "Failed to generate login page"})
+		}
+		w.Write([]byte(createPage("Manesei (login)", template.HTML(pageBuilder.String()))))
+	})
+}
+
+func serveLogout() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie(sessionCookie); err == nil {
+			sessions.Lock()
+			delete(sessions.tokens, cookie.Value)
+			sessions.Unlock()
+		}
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: appPath("/"), MaxAge: -1})
+		http.Redirect(w, r, appPath("/login"), http.StatusSeeOther)
+	})
+}
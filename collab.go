@@ -0,0 +1,323 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	collabSnapshotInterval = 30 * time.Second // How often the edited text is saved
+	collabHistory          = 1000             // Number of operations kept for clients which are behind
+)
+
+// collabMessage is sent between the server and the editors.
+type collabMessage struct {
+	Type     string        `json:"type"` // init, op, ack, base, editors, error
+	Revision int           `json:"revision"`
+	Text     string        `json:"text,omitempty"`
+	Ops      textOperation `json:"ops,omitempty"`
+	Base     string        `json:"base,omitempty"` // See documentForm.Base
+	Editors  int           `json:"editors,omitempty"`
+}
+
+type collabClient struct {
+	user string
+	send chan collabMessage
+}
+
+// collabSession is the shared state of a document edited together.
+// The server decides the order of the operations, and the editors
+// transform their own operations over the ones they receive.
+type collabSession struct {
+	sync.Mutex
+	id       string
+	text     []uint16
+	revision int             // Number of operations applied
+	history  []textOperation // The last operations, ending at revision
+	saved    string          // Content as it was last saved or loaded
+	authors  map[string]bool // Users who edited the text since it was saved
+	clients  map[*collabClient]bool
+	stop     chan struct{}
+}
+
+var collabSessions = struct {
+	sync.Mutex
+	sessions map[string]*collabSession
+}{sessions: make(map[string]*collabSession)}
+
+// splitFile splits the body of a file into the lines with the
+// title and headers, and the content, like insertDocument.
+func splitFile(body string) (head []string, content string) {
+	lines := strings.Split(body, "\n")
+	counter := 1
+	for _, line := range lines[1:] {
+		counter++
+		if strings.TrimSpace(line) == "" || len(strings.SplitN(line, ":", 2)) == 1 {
+			break
+		}
+	}
+	if counter > len(lines) {
+		counter = len(lines)
+	}
+	return lines[:counter], strings.Join(lines[counter:], "\n")
+}
+
+// replaceContent returns the body of a file with the content replaced.
+func replaceContent(body, content string) string {
+	head, _ := splitFile(body)
+	if last := head[len(head)-1]; len(head) == 1 || strings.TrimSpace(last) != "" {
+		head = append(head, "") // Separates the headers from the content
+	}
+	return strings.Join(head, "\n") + "\n" + content
+}
+
+// joinSession adds a client to the session of the document, starting it if needed.
+func joinSession(id string, client *collabClient) (*collabSession, bool) {
+	collabSessions.Lock()
+	defer collabSessions.Unlock()
+	s, ok := collabSessions.sessions[id]
+	if !ok {
+		f, ok := docIndex.file(id)
+		if !ok {
+			return nil, false
+		}
+		_, content := splitFile(f.Body)
+		content = strings.ReplaceAll(content, "\r\n", "\n")
+		s = &collabSession{
+			id:      id,
+			text:    utf16.Encode([]rune(content)),
+			saved:   content,
+			authors: make(map[string]bool),
+			clients: make(map[*collabClient]bool),
+			stop:    make(chan struct{}),
+		}
+		collabSessions.sessions[id] = s
+		go s.saveRegularly()
+	}
+	s.Lock()
+	s.clients[client] = true
+	client.send <- collabMessage{Type: "init", Revision: s.revision, Text: string(utf16.Decode(s.text)),
+		Base: currentToken(id)}
+	s.broadcastEditors()
+	s.Unlock()
+	return s, true
+}
+
+// leave removes the client from the session. The session ends
+// with saving the text when the last client leaves.
+func (s *collabSession) leave(client *collabClient) {
+	collabSessions.Lock()
+	defer collabSessions.Unlock()
+	s.Lock()
+	defer s.Unlock()
+	if s.clients[client] {
+		delete(s.clients, client)
+		close(client.send)
+	}
+	if len(s.clients) != 0 {
+		s.broadcastEditors()
+		return
+	}
+	delete(collabSessions.sessions, s.id)
+	close(s.stop)
+	s.save()
+}
+
+// send queues a message for the client. Clients which don't keep up are dropped.
+func (s *collabSession) send(client *collabClient, m collabMessage) {
+	select {
+	case client.send <- m:
+	default:
+		log.Println("collab: dropping a slow client of", s.id)
+		delete(s.clients, client)
+		close(client.send)
+	}
+}
+
+func (s *collabSession) broadcastEditors() {
+	for c := range s.clients {
+		s.send(c, collabMessage{Type: "editors", Revision: s.revision, Editors: len(s.clients)})
+	}
+}
+
+// apply applies an operation and sends it to all clients except the author.
+// The operation is transformed over the operations which the author didn't know.
+func (s *collabSession) apply(author *collabClient, revision int, op textOperation) error {
+	start := s.revision - len(s.history)
+	if revision < start || revision > s.revision {
+		return errOperation
+	}
+	for _, other := range s.history[revision-start:] {
+		var err error
+		if op, _, err = transform(op, other); err != nil {
+			return err
+		}
+	}
+	text, err := op.apply(s.text)
+	if err != nil {
+		return err
+	}
+	s.text = text
+	s.revision++
+	s.history = append(s.history, op)
+	if len(s.history) > collabHistory {
+		s.history = s.history[len(s.history)-collabHistory:]
+	}
+	for c := range s.clients {
+		if c == author {
+			s.send(c, collabMessage{Type: "ack", Revision: s.revision})
+		} else {
+			s.send(c, collabMessage{Type: "op", Revision: s.revision, Ops: op})
+		}
+	}
+	if author != nil {
+		s.authors[author.user] = true
+	}
+	return nil
+}
+
+// save writes the text to the store, if it changed. If the document was
+// saved in another way meanwhile, the changes are merged first.
+func (s *collabSession) save() {
+	defer lockDocument(s.id)()
+	f, ok := docIndex.file(s.id)
+	if !ok {
+		return // Deleted
+	}
+	_, content := splitFile(f.Body)
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	text := string(utf16.Decode(s.text))
+	if content != s.saved {
+		merged, _ := merge3(splitLines(s.saved), splitLines(text), splitLines(content))
+		mergedText := utf16.Encode([]rune(strings.Join(merged, "\n")))
+		if err := s.apply(nil, s.revision, replaceOperation(s.text, mergedText)); err != nil {
+			log.Println("collab: failed to merge", s.id+":", err)
+			return
+		}
+		text = string(utf16.Decode(s.text))
+	}
+	if text == content {
+		s.saved = text
+		return
+	}
+
+	var authors []string
+	for a := range s.authors {
+		authors = append(authors, a)
+	}
+	sort.Strings(authors)
+	writeRevision(docFile{Id: s.id, Body: replaceContent(f.Body, text)}, strings.Join(authors, ", "), "Edited together")
+	s.saved = text
+	s.authors = make(map[string]bool)
+	base := currentToken(s.id)
+	for c := range s.clients {
+		s.send(c, collabMessage{Type: "base", Revision: s.revision, Base: base})
+	}
+}
+
+func (s *collabSession) saveRegularly() {
+	ticker := time.NewTicker(collabSnapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			func() {
+				// Errors are reported by panicking, like in the handlers.
+				defer func() {
+					if recovered := recover(); recovered != nil {
+						log.Println("collab: failed to save", s.id+":", recovered)
+					}
+				}()
+				s.Lock()
+				defer s.Unlock()
+				s.save()
+			}()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// serveCollab connects editors of a document over a WebSocket. (/collab/id)
+func serveCollab() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requireWritable()
+		id := strings.TrimPrefix(r.URL.Path, "/collab/")
+		if _, ok := docIndex.slug(id); !ok {
+			panic(appError{Description: "Note with given ID does not exist: " + id, Status: http.StatusNotFound})
+		}
+		requireAccess(r, id, true)
+		user := requestUser(r)
+
+		server := websocket.Server{
+			// Only pages of this server may connect, so that other websites can't
+			// edit the notes with the user's cookies. Browsers always send the origin.
+			Handshake: func(config *websocket.Config, r *http.Request) error {
+				if r.Header.Get("Origin") == "" {
+					return nil
+				}
+				origin, err := url.Parse(r.Header.Get("Origin"))
+				if err != nil || origin.Host != r.Host {
+					return websocket.ErrBadWebSocketOrigin
+				}
+				return nil
+			},
+			Handler: func(conn *websocket.Conn) {
+				defer conn.Close()
+				client := &collabClient{user: user, send: make(chan collabMessage, 256)}
+				s, ok := joinSession(id, client)
+				if !ok {
+					return
+				}
+				go func() {
+					for m := range client.send {
+						if websocket.JSON.Send(conn, m) != nil {
+							conn.Close()
+						}
+					}
+				}()
+				defer s.leave(client)
+				for {
+					var m collabMessage
+					if err := websocket.JSON.Receive(conn, &m); err != nil {
+						return // Closed or invalid message
+					}
+					if m.Type != "op" {
+						continue
+					}
+					joined := func() bool {
+						s.Lock()
+						defer s.Unlock()
+						if _, joined := s.clients[client]; !joined {
+							return false // Dropped
+						}
+						// The session stays usable for the others, even if the operation breaks it.
+						defer func() {
+							if recovered := recover(); recovered != nil {
+								log.Println("collab: failed to apply an operation to", id+":", recovered)
+								s.send(client, collabMessage{Type: "error", Revision: s.revision})
+							}
+						}()
+						if err := s.apply(client, m.Revision, m.Ops); err != nil {
+							// The editor has to start again from the current text.
+							s.send(client, collabMessage{Type: "error", Revision: s.revision})
+						}
+						return true
+					}()
+					if !joined {
+						return
+					}
+				}
+			},
+		}
+		server.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/atmatto/manesei/markdown"
+)
+
+// commands are the command-line modes of the program, used as `manesei command arguments...`.
+var commands = map[string]struct {
+	usage string
+	run   func(args []string) error
+}{
+	"import":  {"import DIRECTORY  imports a tree of Markdown files", importMarkdown},
+	"export":  {"export DIRECTORY  exports all notes as a tree of Markdown files", exportMarkdown},
+	"adduser": {"adduser NAME  adds a user or changes their password, read from the standard input", addUser},
+	"static":  {"static DIRECTORY  exports all notes as a static website", exportStatic},
+}
+
+// runCommand runs a command-line mode. Errors reported
+// by panicking with appError are returned as errors.
+func runCommand(name string, args []string) (err error) {
+	command, ok := commands[name]
+	if !ok {
+		var usage []string
+		for _, c := range commands {
+			usage = append(usage, "\t"+c.usage)
+		}
+		sort.Strings(usage)
+		return errors.New("unknown command " + name + ", available commands:\n" + strings.Join(usage, "\n"))
+	}
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			if e, ok := recovered.(appError); ok {
+				err = &e
+			} else {
+				panic(recovered)
+			}
+		}
+	}()
+	return command.run(args)
+}
+
+// slugify converts a file name into a slug. Names consisting only
+// of dots, like `..`, would refer to directories when exported.
+func slugify(name string) string {
+	slug := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' || r == '.' {
+			return unicode.ToLower(r)
+		}
+		return '-'
+	}, name)
+	if strings.Trim(slug, ".") == "" {
+		slug = strings.Repeat("-", len(slug))
+	}
+	return slug
+}
+
+// exportName returns the name of the file or directory to which the document
+// with the slug is exported. Separators are replaced, and names starting with
+// a dot, which would be hidden or refer to directories, get a prefix.
+func exportName(slug string) string {
+	name := strings.NewReplacer("/", "_", "\\", "_").Replace(slug)
+	if strings.HasPrefix(name, ".") {
+		name = "_" + name
+	}
+	return name
+}
+
+// markdownSlug returns the host and the slug of the document imported
+// from the Markdown file with the given path relative to the imported
+// directory. An `index.md` or `README.md` file is the document of its
+// directory, whose other files are the document's children.
+func markdownSlug(file string) (host, slug string) {
+	dir, base := path.Split(file)
+	dir = strings.TrimSuffix(dir, "/")
+	name := strings.TrimSuffix(base, path.Ext(base))
+	if strings.EqualFold(name, "index") || strings.EqualFold(name, "readme") {
+		if dir == "" {
+			return "", ""
+		}
+		dir, name = path.Split(dir)
+		dir = strings.TrimSuffix(dir, "/")
+	}
+	if dir != "" {
+		host = slugify(path.Base(dir))
+	}
+	return host, slugify(name)
+}
+
+// frontMatter splits YAML-like front matter (`key: value` lines
+// between two `---` lines) from the content of a Markdown file.
+func frontMatter(content string) (headers map[string]string, rest string) {
+	lines := strings.Split(content, "\n")
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) != "---" {
+		return nil, content
+	}
+	headers = make(map[string]string)
+	for i, line := range lines[1:] {
+		if strings.TrimSpace(line) == "---" {
+			return headers, strings.Join(lines[i+2:], "\n")
+		}
+		if kv := strings.SplitN(line, ":", 2); len(kv) == 2 {
+			headers[strings.TrimSpace(kv[0])] = strings.Trim(strings.TrimSpace(kv[1]), `"'`)
+		}
+	}
+	return nil, content // Not terminated
+}
+
+// formatFile returns the body of a file with the given document.
+func formatFile(host, slug, title string, headers map[string]string, content string) string {
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	headersStr := ""
+	for _, k := range keys {
+		headersStr += k + ": " + headers[k] + "\n"
+	}
+	return host + ":" + slug + " " + title + "\n" + headersStr + "\n" + content
+}
+
+func importMarkdown(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: import DIRECTORY")
+	}
+	root := args[0]
+	count := 0
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != root && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !strings.EqualFold(filepath.Ext(p), ".md") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		bytes, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		host, slug := markdownSlug(rel)
+		headers, content := frontMatter(strings.ReplaceAll(string(bytes), "\r\n", "\n"))
+		title := headers["title"]
+		delete(headers, "title")
+		if title == "" {
+			for _, line := range strings.Split(content, "\n") {
+				if strings.HasPrefix(line, "# ") {
+					title = strings.TrimSpace(line[2:])
+				}
+				if strings.TrimSpace(line) != "" {
+					break
+				}
+			}
+		}
+		if title == "" {
+			title = strings.TrimSuffix(path.Base(rel), path.Ext(rel))
+			if strings.EqualFold(title, "index") || strings.EqualFold(title, "readme") {
+				title = path.Base(path.Dir(rel))
+			}
+		}
+
+		content = markdown.FromMarkdown(content, func(url string) string {
+			// Links to other imported files are changed into links to their documents.
+			if strings.Contains(url, ":") || strings.HasPrefix(url, "/") || strings.HasPrefix(url, "#") {
+				return url
+			}
+			target := strings.SplitN(url, "#", 2)[0]
+			if !strings.EqualFold(path.Ext(target), ".md") {
+				return url
+			}
+			_, s := markdownSlug(path.Clean(path.Join(path.Dir(rel), target)))
+			return s
+		})
+
+		body := formatFile(host, slug, title, headers, content)
+		writeRevision(docFile{Id: newDocumentId(), Body: body}, "", "Imported from "+rel)
+		count++
+		return nil
+	})
+	fmt.Println("Imported", count, "files.")
+	return err
+}
+
+func exportMarkdown(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: export DIRECTORY")
+	}
+	root := args[0]
+	docIndex.RLock()
+	defer docIndex.RUnlock()
+	documents := docIndex.documents
+
+	// Documents with children are exported as `slug/index.md`
+	// and their children are placed in the same directory.
+	paths := make(map[string]string)
+	var walk func(slug, dir string)
+	walk = func(slug, dir string) {
+		doc := documents[slug]
+		name := exportName(slug)
+		if slug == "" {
+			paths[slug] = "index.md"
+		} else if len(doc.children) != 0 {
+			dir = path.Join(dir, name)
+			paths[slug] = path.Join(dir, "index.md")
+		} else {
+			paths[slug] = path.Join(dir, name+".md")
+		}
+		for _, child := range doc.children {
+			if documents[child].host != slug && contains(documents[child].alsoIn, slug) {
+				continue // Exported below its primary host
+			}
+			if _, ok := paths[child]; !ok {
+				walk(child, dir)
+			}
+		}
+	}
+	walk("", "")
+
+	count := 0
+	for slug, p := range paths {
+		doc := documents[slug]
+		if doc.id == "" {
+			continue // Placeholders and the default root document
+		}
+		content := markdown.ToMarkdown(doc.content, func(target string) string {
+			if targetPath, ok := paths[target]; ok {
+				rel, err := filepath.Rel(path.Dir(p), targetPath)
+				if err == nil {
+					return filepath.ToSlash(rel)
+				}
+			}
+			return target
+		})
+		frontMatter := "---\ntitle: " + doc.title + "\n"
+		keys := make([]string, 0, len(doc.headers))
+		for k := range doc.headers {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			frontMatter += k + ": " + doc.headers[k] + "\n"
+		}
+		frontMatter += "---\n"
+
+		file := filepath.Join(root, filepath.FromSlash(p))
+		if rel, err := filepath.Rel(root, file); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return errors.New("note " + slug + " would be exported outside of " + root)
+		}
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(file, []byte(frontMatter+content), 0644); err != nil {
+			return err
+		}
+		count++
+	}
+	fmt.Println("Exported", count, "notes.")
+	return nil
+}
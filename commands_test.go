@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestSlugify(t *testing.T) {
+	for name, slug := range map[string]string{"Notes 2024": "notes-2024", "v1.2": "v1.2", ".": "-", "..": "--"} {
+		if s := slugify(name); s != slug {
+			t.Errorf("slugify(%q) = %q, expected %q", name, s, slug)
+		}
+	}
+}
+
+func TestExportStaysInDirectory(t *testing.T) {
+	useTemporaryStore(t)
+	for id, body := range map[string]string{
+		"up":     ":.. Up\n\n",
+		"child":  "..:child Child\n\n",
+		"dot":    ":. Dot\n\n",
+		"nested": ".:nested Nested\n\n",
+		"sep":    ":a/b Separator\n\n",
+		"under":  "a/b:under Under\n\n",
+	} {
+		writeRevision(docFile{id, body}, "", "")
+	}
+	parent := t.TempDir()
+	root := filepath.Join(parent, "export")
+	if err := exportMarkdown([]string{root}); err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	filepath.WalkDir(parent, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			rel, _ := filepath.Rel(parent, p)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return err
+	})
+	sort.Strings(files)
+	expected := []string{
+		"export/_../child.md", "export/_../index.md", "export/_./index.md", "export/_./nested.md",
+		"export/a_b/index.md", "export/a_b/under.md",
+	}
+	if len(files) != len(expected) {
+		t.Fatalf("exported %v, expected %v", files, expected)
+	}
+	for i := range files {
+		if files[i] != expected[i] {
+			t.Fatalf("exported %v, expected %v", files, expected)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(parent, "child.md")); err == nil {
+		t.Error("a note was exported outside of the directory")
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	useTemporaryStore(t)
+	originals := map[string]string{
+		"notes": ":notes Notes\nstatus: draft\ntags: a, b\n\n# Notes\n- see {child the child}\n  . first\n  . second\n\n```go\nfunc f() {}\n```\n",
+		"child": "notes:child Child: a_b\n\n==mark== a^2^ \\{x\\}\n",
+	}
+	for id, body := range originals {
+		writeRevision(docFile{id, body}, "", "")
+	}
+	expected := make(map[string]document)
+	for slug := range originals {
+		expected[slug] = docIndex.documents[slug]
+	}
+	root := t.TempDir()
+	if err := exportMarkdown([]string{root}); err != nil {
+		t.Fatal(err)
+	}
+
+	useTemporaryStore(t)
+	if err := importMarkdown([]string{root}); err != nil {
+		t.Fatal(err)
+	}
+	for slug, original := range expected {
+		doc, ok := docIndex.documents[slug]
+		if !ok {
+			t.Errorf("%s wasn't imported", slug)
+			continue
+		}
+		if doc.host != original.host || doc.title != original.title {
+			t.Errorf("%s: imported %q:%s %q, expected %q:%s %q", slug, doc.host, slug, doc.title, original.host, slug, original.title)
+		}
+		if !reflect.DeepEqual(doc.headers, original.headers) {
+			t.Errorf("%s: imported headers %v, expected %v", slug, doc.headers, original.headers)
+		}
+		if doc.content != original.content {
+			t.Errorf("%s: imported content %q, expected %q", slug, doc.content, original.content)
+		}
+	}
+}
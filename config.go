@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// config holds the settings given by command-line flags or environment variables.
+var config struct {
+	listen   string // Address of the HTTP server
+	base     string // Path prefix of all URLs, without the trailing slash
+	readOnly bool   // Serve the notes without allowing to modify them
+	users    string // File with the users who can log in, authentication is disabled if empty
+	public   bool   // Allow reading the notes without logging in
+}
+
+// parseConfig parses the flags, which default to the values of the
+// environment variables, and validates the settings. It returns the
+// remaining arguments.
+func parseConfig(args []string) ([]string, error) {
+	readOnly, err := envBool("MANESEI_READ_ONLY")
+	if err != nil {
+		return nil, err
+	}
+	public, err := envBool("MANESEI_PUBLIC")
+	if err != nil {
+		return nil, err
+	}
+
+	flags := flag.NewFlagSet("manesei", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: manesei [flags] [command arguments...]")
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&config.listen, "listen", envOr("MANESEI_LISTEN", ":8000"), "`address` of the HTTP server (MANESEI_LISTEN)")
+	flags.StringVar(&dataDirectory, "data", envOr("MANESEI_DATA", dataDirectory), "`directory` in which the notes are stored (MANESEI_DATA)")
+	flags.StringVar(&config.base, "base", envOr("MANESEI_BASE", "/"), "URL `path` under which the notes are served, like /notes/ (MANESEI_BASE)")
+	flags.BoolVar(&config.readOnly, "read-only", readOnly, "disallow modifying the notes (MANESEI_READ_ONLY)")
+	flags.StringVar(&config.users, "users", envOr("MANESEI_USERS", ""), "`file` with the users allowed to log in, enables authentication (MANESEI_USERS)")
+	flags.BoolVar(&config.public, "public", public, "allow reading the notes without logging in (MANESEI_PUBLIC)")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if _, port, err := net.SplitHostPort(config.listen); err != nil {
+		return nil, fmt.Errorf("invalid listen address %q: %v", config.listen, err)
+	} else if _, err := net.LookupPort("tcp", port); err != nil {
+		return nil, fmt.Errorf("invalid listen address %q: %v", config.listen, err)
+	}
+
+	if dataDirectory == "" {
+		return nil, errors.New("the data directory must not be empty")
+	}
+	if info, err := os.Stat(dataDirectory); err == nil && !info.IsDir() {
+		return nil, fmt.Errorf("data directory %q is not a directory", dataDirectory)
+	} else if err != nil && !(errors.Is(err, os.ErrNotExist) && !config.readOnly) {
+		// In read-only mode the directory isn't created.
+		return nil, fmt.Errorf("can't access the data directory: %v", err)
+	}
+
+	base, err := url.Parse(config.base)
+	if err != nil || base.Scheme != "" || base.Host != "" || base.RawQuery != "" || base.Fragment != "" ||
+		!strings.HasPrefix(config.base, "/") || strings.Contains(config.base, "//") {
+		return nil, fmt.Errorf("invalid base path %q: must be a path starting with a slash, like /notes/", config.base)
+	}
+	config.base = strings.TrimSuffix(config.base, "/")
+
+	return flags.Args(), nil
+}
+
+// envOr returns the value of the environment variable or the fallback if it isn't set.
+func envOr(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return fallback
+}
+
+// envBool returns the boolean value of the environment variable, false if it isn't set.
+func envBool(key string) (bool, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: must be true or false", key, v)
+	}
+	return b, nil
+}
+
+// appPath returns the URL path of an absolute path within the application.
+func appPath(p string) string {
+	return config.base + p
+}
+
+// requireWritable rejects the request if the notes are read-only.
+func requireWritable() {
+	if config.readOnly {
+		panic(appError{Description: "The notes are read-only", Status: http.StatusForbidden})
+	}
+}
+
+// withBase serves the handler under the base path.
+func withBase(next http.Handler) http.Handler {
+	if config.base == "" {
+		return next
+	}
+	stripped := http.StripPrefix(config.base, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == config.base {
+			http.Redirect(w, r, config.base+"/", http.StatusMovedPermanently)
+		} else if strings.HasPrefix(r.URL.Path, config.base+"/") {
+			stripped.ServeHTTP(w, r)
+		} else {
+			http.NotFound(w, r)
+		}
+	})
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const diffContext = 3 // Number of unchanged lines shown around changes
+
+type diffOp int
+
+const (
+	diffEqual diffOp = iota
+	diffDelete
+	diffInsert
+)
+
+type diffEdit struct {
+	op   diffOp
+	text string
+}
+
+// diffStrings returns the edits which transform a into b, based on the longest
+// common subsequence. It uses the algorithm from "An O(ND) Difference Algorithm
+// and Its Variations" by Eugene W. Myers in linear space, so that the memory
+// used doesn't grow with the product of the lengths.
+func diffStrings(a, b []string) (edits []diffEdit) {
+	// Common prefix and suffix are trimmed to save time.
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	for _, s := range a[:prefix] {
+		edits = append(edits, diffEdit{diffEqual, s})
+	}
+	common := a[len(a)-suffix:]
+	edits = diffRange(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix], edits)
+	for _, s := range common {
+		edits = append(edits, diffEdit{diffEqual, s})
+	}
+	return
+}
+
+// diffRange appends the edits which transform a into b. The parts before and
+// after the middle snake of the shortest edit script are diffed recursively.
+func diffRange(a, b []string, edits []diffEdit) []diffEdit {
+	if len(a) == 0 || len(b) == 0 {
+		for _, s := range a {
+			edits = append(edits, diffEdit{diffDelete, s})
+		}
+		for _, s := range b {
+			edits = append(edits, diffEdit{diffInsert, s})
+		}
+		return edits
+	}
+	x, y, u, v, d := middleSnake(a, b)
+	if d > 1 {
+		edits = diffRange(a[:x], b[:y], edits)
+		for _, s := range a[x:u] {
+			edits = append(edits, diffEdit{diffEqual, s})
+		}
+		return diffRange(a[u:], b[v:], edits)
+	}
+	// The shorter sequence is the longer one with at most one line removed.
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, diffEdit{diffEqual, a[i]})
+			i++
+			j++
+		case len(a)-i > len(b)-j:
+			edits = append(edits, diffEdit{diffDelete, a[i]})
+			i++
+		default:
+			edits = append(edits, diffEdit{diffInsert, b[j]})
+			j++
+		}
+	}
+	return edits
+}
+
+// middleSnake finds the middle snake of the shortest edit script transforming
+// a into b, from (x, y) to (u, v), by searching from both ends at once, and
+// returns the number of edits d. The sequences must not be empty.
+func middleSnake(a, b []string) (x, y, u, v, d int) {
+	n, m := len(a), len(b)
+	max := (n + m + 1) / 2
+	offset := max + 1
+	// forward[offset+k] is the furthest x reached on the diagonal k = x-y from
+	// the start, backward[offset+k] the furthest distance from the end reached
+	// on the diagonal k of the reversed sequences, which is delta-k in a and b.
+	forward := make([]int, 2*offset+1)
+	backward := make([]int, 2*offset+1)
+	delta := n - m
+	odd := delta%2 != 0
+	for d = 0; d <= max; d++ {
+		for k := -d; k <= d; k += 2 {
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y = x - k
+			u, v = x, y
+			for u < n && v < m && a[u] == b[v] {
+				u++
+				v++
+			}
+			forward[offset+k] = u
+			if odd && delta-k >= -(d-1) && delta-k <= d-1 && u+backward[offset+delta-k] >= n {
+				return x, y, u, v, 2*d - 1
+			}
+		}
+		for k := -d; k <= d; k += 2 {
+			var xr int
+			if k == -d || (k != d && backward[offset+k-1] < backward[offset+k+1]) {
+				xr = backward[offset+k+1]
+			} else {
+				xr = backward[offset+k-1] + 1
+			}
+			yr := xr - k
+			ur, vr := xr, yr
+			for ur < n && vr < m && a[n-1-ur] == b[m-1-vr] {
+				ur++
+				vr++
+			}
+			backward[offset+k] = ur
+			if !odd && delta-k >= -d && delta-k <= d && forward[offset+delta-k]+ur >= n {
+				return n - ur, m - vr, n - xr, m - yr, 2 * d
+			}
+		}
+	}
+	panic("diff: no middle snake") // Unreachable, the paths meet within max steps.
+}
+
+// splitWords splits a line into words and the characters between them.
+func splitWords(line string) (words []string) {
+	isWordRune := func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r)
+	}
+	runes := []rune(line)
+	for i := 0; i < len(runes); {
+		j := i + 1
+		if isWordRune(runes[i]) {
+			for j < len(runes) && isWordRune(runes[j]) {
+				j++
+			}
+		}
+		words = append(words, string(runes[i:j]))
+		i = j
+	}
+	return
+}
+
+// diffWords returns both lines as HTML with the differing words marked.
+func diffWords(old, new string) (oldHTML, newHTML template.HTML) {
+	var o, n strings.Builder
+	edits := diffStrings(splitWords(old), splitWords(new))
+	for i := 0; i < len(edits); {
+		// Consecutive edits of the same kind are marked together.
+		op := edits[i].op
+		var text string
+		for ; i < len(edits) && edits[i].op == op; i++ {
+			text += template.HTMLEscapeString(edits[i].text)
+		}
+		switch op {
+		case diffEqual:
+			o.WriteString(text)
+			n.WriteString(text)
+		case diffDelete:
+			o.WriteString("<del>" + text + "</del>")
+		case diffInsert:
+			n.WriteString("<ins>" + text + "</ins>")
+		}
+	}
+	return template.HTML(o.String()), template.HTML(n.String())
+}
+
+// diffRow is a row of a side-by-side diff. In the inline view, a row with
+// both sides changed is displayed as a deleted line followed by an inserted one.
+type diffRow struct {
+	Skip      bool // Unchanged lines are omitted in place of this row.
+	OldNumber int
+	NewNumber int
+	Old       template.HTML
+	New       template.HTML
+	OldKind   string // "equal", "delete" or "" if the line is absent
+	NewKind   string // "equal", "insert" or "" if the line is absent
+}
+
+// diffRows compares two texts line by line and, for changed
+// lines, word by word.
+func diffRows(old, new string) (rows []diffRow) {
+	edits := diffStrings(strings.Split(old, "\n"), strings.Split(new, "\n"))
+	oldNumber, newNumber := 0, 0
+	for i := 0; i < len(edits); {
+		if edits[i].op == diffEqual {
+			oldNumber++
+			newNumber++
+			text := template.HTML(template.HTMLEscapeString(edits[i].text))
+			rows = append(rows, diffRow{
+				OldNumber: oldNumber, NewNumber: newNumber,
+				Old: text, New: text,
+				OldKind: "equal", NewKind: "equal",
+			})
+			i++
+			continue
+		}
+		// A block of changes; deleted lines are paired with inserted ones.
+		var deleted, inserted []string
+		for ; i < len(edits) && edits[i].op != diffEqual; i++ {
+			if edits[i].op == diffDelete {
+				deleted = append(deleted, edits[i].text)
+			} else {
+				inserted = append(inserted, edits[i].text)
+			}
+		}
+		for k := 0; k < len(deleted) || k < len(inserted); k++ {
+			var row diffRow
+			switch {
+			case k < len(deleted) && k < len(inserted):
+				row.Old, row.New = diffWords(deleted[k], inserted[k])
+			case k < len(deleted):
+				row.Old = template.HTML(template.HTMLEscapeString(deleted[k]))
+			default:
+				row.New = template.HTML(template.HTMLEscapeString(inserted[k]))
+			}
+			if k < len(deleted) {
+				oldNumber++
+				row.OldNumber, row.OldKind = oldNumber, "delete"
+			}
+			if k < len(inserted) {
+				newNumber++
+				row.NewNumber, row.NewKind = newNumber, "insert"
+			}
+			rows = append(rows, row)
+		}
+	}
+	return collapseRows(rows)
+}
+
+// collapseRows replaces unchanged lines which are far from any change with skip rows.
+func collapseRows(rows []diffRow) (collapsed []diffRow) {
+	near := make([]bool, len(rows))
+	for i, row := range rows {
+		if row.OldKind != "equal" {
+			for j := i - diffContext; j <= i+diffContext; j++ {
+				if j >= 0 && j < len(rows) {
+					near[j] = true
+				}
+			}
+		}
+	}
+	for i, row := range rows {
+		if near[i] {
+			collapsed = append(collapsed, row)
+		} else if len(collapsed) == 0 || !collapsed[len(collapsed)-1].Skip {
+			collapsed = append(collapsed, diffRow{Skip: true})
+		}
+	}
+	return
+}
+
+// readRevision returns the content of the given generation of a file. The
+// generation 0 means the current version. If the file doesn't exist, the
+// second return value is false.
+func readRevision(id string, generation uint64) (string, bool) {
+	f, err := docs.Open(id, generation)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false
+	} else if err != nil {
+		panic(appError{Err: err, Description: "Failed to open document"})
+	}
+	defer f.Close()
+	bytes, err := io.ReadAll(f)
+	if err != nil {
+		panic(appError{Err: err, Description: "Failed to read file"})
+	}
+	return string(bytes), true
+}
+
+// parseRevision parses a revision name used in history URLs.
+func parseRevision(revision string) uint64 {
+	if revision == "current" {
+		return 0
+	}
+	generation, err := strconv.ParseUint(revision, 10, 64)
+	if err != nil {
+		panic(appError{Err: err, Description: "Invalid revision: " + revision, Status: http.StatusBadRequest})
+	}
+	return generation
+}
+
+// serveDiff writes a page comparing two revisions of a document.
+// The range has the form `a..b`.
+func serveDiff(w http.ResponseWriter, r *http.Request, id, revisionRange string) {
+	revisions := strings.SplitN(revisionRange, "..", 2)
+	old, oldExists := readRevision(id, parseRevision(revisions[0]))
+	new, newExists := readRevision(id, parseRevision(revisions[1]))
+	if !oldExists && !newExists {
+		panic(appError{Description: "Revisions do not exist", Status: http.StatusNotFound})
+	}
+
+	split := r.URL.Query().Get("view") == "split"
+	var pageBuilder strings.Builder
+	err := templates.ExecuteTemplate(&pageBuilder, "diff.html", struct {
+		Id    string
+		Old   string
+		New   string
+		Split bool
+		Rows  []diffRow
+	}{id, revisions[0], revisions[1], split, diffRows(old, new)})
+	if err != nil {
+		panic(appError{Err: err, Description: "Failed to generate diff page"})
+	}
+	w.Write([]byte(createPage("Manesei (diff)", template.HTML(pageBuilder.String()))))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// lcsLength returns the length of the longest common subsequence of a and b.
+func lcsLength(a, b []string) int {
+	previous := make([]int, len(b)+1)
+	for i := range a {
+		current := make([]int, len(b)+1)
+		for j := range b {
+			switch {
+			case a[i] == b[j]:
+				current[j+1] = previous[j] + 1
+			case previous[j+1] >= current[j]:
+				current[j+1] = previous[j+1]
+			default:
+				current[j+1] = current[j]
+			}
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+func checkDiff(t *testing.T, a, b []string) {
+	t.Helper()
+	var oldLines, newLines []string
+	equal := 0
+	for _, edit := range diffStrings(a, b) {
+		switch edit.op {
+		case diffEqual:
+			oldLines = append(oldLines, edit.text)
+			newLines = append(newLines, edit.text)
+			equal++
+		case diffDelete:
+			oldLines = append(oldLines, edit.text)
+		case diffInsert:
+			newLines = append(newLines, edit.text)
+		}
+	}
+	if strings.Join(oldLines, "\n") != strings.Join(a, "\n") || strings.Join(newLines, "\n") != strings.Join(b, "\n") {
+		t.Fatalf("%q -> %q: the edits give %q -> %q", a, b, oldLines, newLines)
+	}
+	if lcs := lcsLength(a, b); equal != lcs {
+		t.Fatalf("%q -> %q: %d equal lines, expected %d", a, b, equal, lcs)
+	}
+}
+
+func TestDiffStrings(t *testing.T) {
+	for _, test := range [][2]string{
+		{"", ""}, {"a", ""}, {"", "a"}, {"a b c", "a b c"}, {"a b c", "a c"}, {"a c", "a b c"},
+		{"a b c a b b a", "c b a b a c"}, {"x y", "y x"}, {"a b", "c d"},
+	} {
+		checkDiff(t, strings.Fields(test[0]), strings.Fields(test[1]))
+	}
+	r := rand.New(rand.NewSource(1))
+	random := func() (lines []string) {
+		for i := r.Intn(30); i > 0; i-- {
+			lines = append(lines, strconv.Itoa(r.Intn(5)))
+		}
+		return
+	}
+	for i := 0; i < 2000; i++ {
+		checkDiff(t, random(), random())
+	}
+}
+
+func TestDiffLongTexts(t *testing.T) {
+	var a, b []string
+	for i := 0; i < 20000; i++ {
+		a = append(a, "line "+strconv.Itoa(i))
+		if i%100 == 50 {
+			b = append(b, "changed "+strconv.Itoa(i))
+		} else if i%100 != 70 {
+			b = append(b, "line "+strconv.Itoa(i))
+		}
+	}
+	checkDiff(t, a[:2000], b[:2000]) // The quadratic check of the result is kept short.
+	equal := 0
+	for _, edit := range diffStrings(a, b) {
+		if edit.op == diffEqual {
+			equal++
+		}
+	}
+	if expected := len(a) - 2*len(a)/100; equal != expected {
+		t.Errorf("%d equal lines, expected %d", equal, expected)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	watchInterval  = 2 * time.Second  // How often the data directory is checked for changes
+	eventKeepAlive = 30 * time.Second // Interval of comments keeping idle event streams open
+)
+
+// changes notifies the viewers of documents when the documents change.
+var changes = struct {
+	sync.Mutex
+	subscribers map[chan struct{}]string // Slugs of the viewed documents
+}{subscribers: make(map[chan struct{}]string)}
+
+// subscribe returns a channel which receives a value when the document with the
+// given slug or its children change. It has to be passed to unsubscribe.
+func subscribe(slug string) chan struct{} {
+	c := make(chan struct{}, 1)
+	changes.Lock()
+	changes.subscribers[c] = slug
+	changes.Unlock()
+	return c
+}
+
+func unsubscribe(c chan struct{}) {
+	changes.Lock()
+	delete(changes.subscribers, c)
+	changes.Unlock()
+}
+
+// notifyChanged notifies the viewers of the documents with the given slugs.
+func notifyChanged(slugs []string) {
+	changed := make(map[string]bool, len(slugs))
+	for _, slug := range slugs {
+		changed[slug] = true
+	}
+	changes.Lock()
+	defer changes.Unlock()
+	for c, slug := range changes.subscribers {
+		if changed[slug] {
+			select {
+			case c <- struct{}{}:
+			default: // A notification is already waiting
+			}
+		}
+	}
+}
+
+// affected returns the slugs of the documents whose pages show the document
+// with the given id: the document itself, its hosts, and the hosts of the
+// hosts, which list the children of their children. The caller must hold the lock.
+func (idx *documentIndex) affected(id string) (slugs []string) {
+	slug, ok := idx.slugs[id]
+	if !ok {
+		return nil
+	}
+	slugs = append(slugs, slug)
+	for _, host := range idx.documents[slug].hosts() {
+		slugs = append(slugs, host)
+		slugs = append(slugs, idx.documents[host].hosts()...)
+	}
+	return
+}
+
+// serveEvents streams Server-Sent Events to a viewer page, which reloads
+// when the viewed document or its children change. (/events/slug)
+func serveEvents() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slug := strings.TrimPrefix(r.URL.Path, "/events/")
+		v := requestVisitor(r)
+		docIndex.RLock()
+		readable := v.canRead(docIndex.documents, slug)
+		docIndex.RUnlock()
+		if !readable {
+			panic(appError{Description: "You don't have access to this note", Status: http.StatusForbidden})
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			panic(appError{Description: "Streaming is not supported"})
+		}
+
+		c := subscribe(slug)
+		defer unsubscribe(c)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		keepAlive := time.NewTicker(eventKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-c:
+				io.WriteString(w, "event: change\ndata: \n\n")
+			case <-keepAlive.C:
+				io.WriteString(w, ": keep-alive\n\n")
+			case <-r.Context().Done():
+				return
+			}
+			flusher.Flush()
+		}
+	})
+}
+
+// watchFiles updates the index when the files in the data directory are changed
+// by other programs. The directory is checked in regular intervals.
+func watchFiles() {
+	type state struct {
+		modified time.Time
+		size     int64
+	}
+	scan := func() map[string]state {
+		files, err := docs.List("/", false, true)
+		if err != nil {
+			return nil
+		}
+		states := make(map[string]state, len(files))
+		for _, id := range files {
+			id = strings.TrimPrefix(id, "/")
+			if info, err := docs.Stat(id, false); err == nil {
+				states[id] = state{info.ModTime(), info.Size()}
+			}
+		}
+		return states
+	}
+
+	previous := scan()
+	for range time.Tick(watchInterval) {
+		current := scan()
+		if current == nil {
+			continue
+		}
+		for id, s := range current {
+			if p, ok := previous[id]; ok && p == s {
+				continue
+			}
+			f, err := docs.Open(id, 0)
+			if err != nil {
+				continue
+			}
+			body, err := io.ReadAll(f)
+			f.Close()
+			if err != nil {
+				continue
+			}
+			// Files written by the program are already indexed.
+			if indexed, ok := docIndex.file(id); !ok || indexed.Body != string(body) {
+				log.Println("file changed on disk:", id)
+				docIndex.put(docFile{Id: id, Body: string(body)})
+			}
+		}
+		for id := range previous {
+			if _, ok := current[id]; !ok {
+				if _, err := docs.Stat(id, false); errors.Is(err, os.ErrNotExist) {
+					if _, ok := docIndex.file(id); ok {
+						log.Println("file removed from disk:", id)
+						docIndex.remove(id)
+					}
+				}
+			}
+		}
+		previous = current
+	}
+}
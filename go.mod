@@ -5,3 +5,7 @@ go 1.18
 require github.com/google/uuid v1.3.0
 
 require github.com/atmatto/atylar v0.0.0-20220412170558-67531e495188
+
+require golang.org/x/crypto v0.14.0
+
+require golang.org/x/net v0.17.0
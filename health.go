@@ -0,0 +1,158 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// healthDocument is a document mentioned in the health report.
+type healthDocument struct {
+	Id          string
+	Slug        string
+	Title       string
+	Host        string
+	DuplicateOf string
+}
+
+type healthPlaceholder struct {
+	Slug     string
+	Children []healthDocument // Documents which have the placeholder as their host
+}
+
+type healthLink struct {
+	Document healthDocument
+	Target   string
+}
+
+// healthReport lists the problems of the structure of the documents.
+type healthReport struct {
+	Cycles       [][]healthDocument // Documents whose hosts lead back to them, in the order of the hosts
+	Placeholders []healthPlaceholder
+	Duplicates   []healthDocument
+	BrokenLinks  []healthLink
+}
+
+func newHealthDocument(doc document) healthDocument {
+	return healthDocument{doc.id, doc.slug, doc.title, doc.host, doc.duplicateOf}
+}
+
+// hostCycles returns the cycles of hosts, which make the documents
+// in them unreachable from the root document.
+func hostCycles(documents map[string]document) (cycles [][]string) {
+	slugs := make([]string, 0, len(documents))
+	for slug := range documents {
+		slugs = append(slugs, slug)
+	}
+	sort.Strings(slugs)
+
+	const (
+		walking = 1
+		done    = 2
+	)
+	state := make(map[string]int)
+	for _, slug := range slugs {
+		var chain []string
+		s := slug
+		for s != "" && state[s] == 0 {
+			state[s] = walking
+			chain = append(chain, s)
+			if documents[s].host == s {
+				s = "" // Root
+				break
+			}
+			s = documents[s].host
+		}
+		if state[s] == walking {
+			for i, c := range chain {
+				if c == s {
+					cycles = append(cycles, chain[i:])
+					break
+				}
+			}
+		}
+		for _, c := range chain {
+			state[c] = done
+		}
+	}
+	return
+}
+
+// noteLinkTarget reports whether the target of a `{}` link refers to a
+// document, rather than to a URL with a scheme or an absolute path.
+func noteLinkTarget(target string) bool {
+	if target == "" || strings.ContainsAny(target[:1], "/.#?") {
+		return false
+	}
+	i := strings.IndexAny(target, ":/?#")
+	return i == -1 || target[i] != ':'
+}
+
+// health returns the problems found in the documents which the visitor can read.
+func (idx *documentIndex) health(v visitor) (report healthReport) {
+	idx.RLock()
+	defer idx.RUnlock()
+	documents := idx.documents
+	readable := func(slug string) bool {
+		return v.canRead(documents, slug)
+	}
+
+	for _, cycle := range hostCycles(documents) {
+		var members []healthDocument
+		for _, slug := range cycle {
+			if readable(slug) {
+				members = append(members, newHealthDocument(documents[slug]))
+			}
+		}
+		if len(members) != 0 {
+			report.Cycles = append(report.Cycles, members)
+		}
+	}
+
+	slugs := make([]string, 0, len(documents))
+	for slug := range documents {
+		slugs = append(slugs, slug)
+	}
+	sort.Strings(slugs)
+	for _, slug := range slugs {
+		doc := documents[slug]
+		if !readable(slug) {
+			continue
+		}
+		if doc.id == "" {
+			if slug == "" || len(doc.claimants) != 0 {
+				continue // Default root document or a contested slug
+			}
+			placeholder := healthPlaceholder{Slug: slug}
+			for _, child := range doc.children {
+				if readable(child) {
+					placeholder.Children = append(placeholder.Children, newHealthDocument(documents[child]))
+				}
+			}
+			report.Placeholders = append(report.Placeholders, placeholder)
+			continue
+		}
+		if doc.isDuplicate {
+			report.Duplicates = append(report.Duplicates, newHealthDocument(doc))
+		}
+		for _, target := range doc.links {
+			if _, ok := documents[target]; !ok && noteLinkTarget(target) {
+				report.BrokenLinks = append(report.BrokenLinks, healthLink{newHealthDocument(doc), target})
+			}
+		}
+	}
+	return
+}
+
+// serveHealth shows the health report. (/health)
+func serveHealth() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var pageBuilder strings.Builder
+		err := templates.ExecuteTemplate(&pageBuilder, "health.html", docIndex.health(requestVisitor(r)))
+		if err != nil {
+			panic(appError{Err: err, Description: "Failed to generate health page"})
+		}
+		w.Write([]byte(createPage("Manesei (health)", template.HTML(pageBuilder.String()))))
+	})
+}
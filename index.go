@@ -0,0 +1,230 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// documentIndex holds all documents in memory. It is built once at startup
+// and then updated incrementally whenever a file is written, so that the
+// store doesn't have to be read and parsed on every request.
+type documentIndex struct {
+	sync.RWMutex
+	files     map[string]docFile  // Source files by id
+	slugs     map[string]string   // Slugs by document id
+	documents map[string]document // Documents by slug, as created by loadDocuments
+	inverted  invertedIndex       // Terms of documents, used for searching
+}
+
+var docIndex *documentIndex
+
+func newDocumentIndex(docFiles []docFile) *documentIndex {
+	idx := &documentIndex{
+		files:     make(map[string]docFile, len(docFiles)),
+		slugs:     make(map[string]string, len(docFiles)),
+		documents: loadDocuments(docFiles),
+		inverted:  newInvertedIndex(),
+	}
+	for _, f := range docFiles {
+		idx.files[f.Id] = f
+	}
+	for slug, doc := range idx.documents {
+		if doc.id != "" {
+			idx.slugs[doc.id] = slug
+			idx.inverted.add(doc.id, doc)
+		}
+	}
+	return idx
+}
+
+// byId returns the document with the given id.
+func (idx *documentIndex) byId(id string) (doc document, ok bool) {
+	idx.RLock()
+	defer idx.RUnlock()
+	slug, ok := idx.slugs[id]
+	if !ok {
+		return
+	}
+	doc = idx.documents[slug]
+	// The slices may be modified after the lock is released.
+	doc.children = append([]string(nil), doc.children...)
+	doc.links = append([]string(nil), doc.links...)
+	doc.backlinks = append([]string(nil), doc.backlinks...)
+	return
+}
+
+// put adds the document stored in the given file to the index,
+// replacing the previous version if it was already indexed.
+func (idx *documentIndex) put(f docFile) {
+	idx.Lock()
+	defer idx.Unlock()
+	affected := idx.affected(f.Id)
+	idx.detach(f.Id)
+	idx.attach(f)
+	notifyChanged(append(affected, idx.affected(f.Id)...))
+}
+
+// remove removes the document with the given id from the index.
+func (idx *documentIndex) remove(id string) {
+	idx.Lock()
+	defer idx.Unlock()
+	notifyChanged(idx.affected(id))
+	idx.detach(id)
+}
+
+// attach adds a document which isn't yet present in the index
+// and connects it with its host. The caller must hold the lock.
+func (idx *documentIndex) attach(f docFile) {
+	documents := idx.documents
+	if wanted := parseFile(f).slug; documents[wanted].id != "" && documents[wanted].id != f.Id {
+		// The slug becomes contested. The document which had it is attached
+		// again, so that it is connected under its claimant slug.
+		other := idx.files[documents[wanted].id]
+		idx.detach(other.Id)
+		contested, ok := documents[wanted]
+		if !ok {
+			contested = placeholderDocument(wanted)
+			contested.backlinks = linkingTo(documents, wanted)
+		}
+		contested.claimants = []string{claimantSlug(wanted, other.Id)}
+		documents[wanted] = contested
+		idx.attach(other)
+	}
+	slug := insertDocument(f, documents)
+	idx.files[f.Id] = f
+	idx.slugs[f.Id] = slug
+
+	doc := documents[slug]
+	if slug != "" {
+		// The document may have replaced a placeholder,
+		// which was a child of the root document.
+		documents[""] = documents[""].removeChild(slug)
+	}
+	for _, host := range doc.hosts() {
+		if h, ok := documents[host]; !ok || (h.id == "" && host != "") {
+			if !ok {
+				placeholder := placeholderDocument(host)
+				placeholder.backlinks = linkingTo(documents, host)
+				documents[host] = placeholder
+			}
+			// Hosts which don't exist are children of the root document.
+			documents[""] = documents[""].addChild(host)
+			sort.Strings(documents[""].children)
+		}
+		documents[host] = documents[host].addChild(doc.slug)
+		sort.Strings(documents[host].children)
+	}
+
+	doc = documents[slug]
+	doc.backlinks = linkingTo(documents, slug)
+	documents[slug] = doc
+	idx.inverted.add(f.Id, doc)
+	for _, target := range doc.links {
+		if t, ok := documents[target]; ok && target != slug {
+			documents[target] = t.addBacklink(slug)
+			sort.Strings(documents[target].backlinks)
+		}
+	}
+}
+
+// detach removes a document from the index, disconnects it from its host
+// and, if it had children, replaces it with a placeholder. If other
+// documents were renamed because they had the same slug, one of them
+// takes over the freed slug. The caller must hold the lock.
+func (idx *documentIndex) detach(id string) {
+	slug, ok := idx.slugs[id]
+	if !ok {
+		return
+	}
+	delete(idx.slugs, id)
+	delete(idx.files, id)
+	idx.inverted.remove(id)
+
+	documents := idx.documents
+	doc := documents[slug]
+	for _, target := range doc.links {
+		if t, ok := documents[target]; ok {
+			documents[target] = t.removeBacklink(slug)
+		}
+	}
+	for _, hostSlug := range doc.hosts() {
+		host := documents[hostSlug].removeChild(slug)
+		if host.id == "" && host.slug != "" && len(host.children) == 0 {
+			// The host was only a placeholder for this document.
+			delete(documents, host.slug)
+			documents[""] = documents[""].removeChild(host.slug)
+		} else {
+			documents[hostSlug] = host
+		}
+	}
+
+	if slug == "" {
+		root := rootDocument()
+		root.children = doc.children
+		root.backlinks = doc.backlinks
+		documents[""] = root
+	} else if len(doc.children) != 0 {
+		placeholder := placeholderDocument(slug)
+		placeholder.children = doc.children
+		placeholder.backlinks = doc.backlinks
+		documents[slug] = placeholder
+		documents[""] = documents[""].addChild(slug)
+		sort.Strings(documents[""].children)
+	} else {
+		delete(documents, slug)
+	}
+
+	if doc.isDuplicate {
+		idx.withdrawClaim(doc.duplicateOf, slug)
+	}
+}
+
+// withdrawClaim removes the claimant from the documents with the contested
+// slug. When only one document is left, it gets the slug back and the page
+// listing the documents is removed. The caller must hold the lock.
+func (idx *documentIndex) withdrawClaim(contestedSlug, claimant string) {
+	documents := idx.documents
+	contested, ok := documents[contestedSlug]
+	if !ok {
+		return
+	}
+	var claimants []string
+	for _, c := range contested.claimants {
+		if c != claimant {
+			claimants = append(claimants, c)
+		}
+	}
+	contested.claimants = claimants
+	documents[contestedSlug] = contested
+
+	switch len(claimants) {
+	case 0:
+		if contestedSlug == "" || len(contested.children) != 0 {
+			break // Root or host of other documents
+		}
+		delete(documents, contestedSlug)
+		documents[""] = documents[""].removeChild(contestedSlug)
+	case 1:
+		last := idx.files[documents[claimants[0]].id]
+		idx.detach(last.Id)
+		idx.attach(last)
+	}
+}
+
+// linkingTo returns the sorted slugs of documents which link to the given
+// slug. The caller must hold the lock.
+func linkingTo(documents map[string]document, slug string) (backlinks []string) {
+	for s, doc := range documents {
+		if s == slug {
+			continue
+		}
+		for _, target := range doc.links {
+			if target == slug {
+				backlinks = append(backlinks, s)
+				break
+			}
+		}
+	}
+	sort.Strings(backlinks)
+	return
+}
@@ -4,12 +4,13 @@ import (
 	"embed"
 	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
 	"github.com/google/uuid"
 	"html/template"
 	"io"
 	"io/ioutil"
 	"log"
-	"math/rand"
 	"net/http"
 	"os"
 	"sort"
@@ -24,7 +25,11 @@ var fontsFS embed.FS
 
 //go:embed templates/*
 var templatesFS embed.FS
-var templates = template.Must(template.ParseFS(templatesFS, "templates/*"))
+var templates = template.Must(template.New("").Funcs(template.FuncMap{
+	"base":           func() string { return config.base },
+	"readOnly":       func() bool { return config.readOnly },
+	"authentication": func() bool { return users != nil },
+}).ParseFS(templatesFS, "templates/*"))
 
 var dataDirectory = "notes"
 var docs atylar.Store
@@ -106,8 +111,8 @@ func loadFiles() []docFile {
 		if err != nil {
 			panic(appError{Err: err, Description: "Failed to open file " + id})
 		}
-		defer fd.Close()
 		body, err := io.ReadAll(fd)
+		fd.Close()
 		if err != nil {
 			panic(appError{Err: err, Description: "Failed to read file " + id})
 		}
@@ -116,16 +121,50 @@ func loadFiles() []docFile {
 	return docFiles
 }
 
+// newDocumentId returns a new, random identifier.
+func newDocumentId() string {
+	return strings.ReplaceAll(uuid.NewString(), ":", "-")
+}
+
+// writeDocument saves the file in the store as a new generation and updates the index.
+func writeDocument(f docFile) {
+	file, err := docs.Write(f.Id)
+	if err != nil {
+		panic(appError{Err: err, Description: "Failed to open file"})
+	}
+	defer file.Close()
+	if _, err := file.WriteString(f.Body); err != nil {
+		panic(appError{Err: err, Description: "Failed to write file"})
+	}
+	docIndex.put(f)
+}
+
 type document struct {
 	id          string
 	host        string
 	slug        string // Document name
-	isDuplicate bool   // An exactly named document already exists
-	duplicateOf string // In case of a duplicate, this stores the original slug
+	isDuplicate bool   // Other documents have the same slug
+	duplicateOf string // In case of a duplicate, this stores the contested slug
 	title       string
 	headers     map[string]string
+	tags        []string // Tags from the `tags` header, see parseTags
+	alsoIn      []string // Additional hosts from the `also-in` header
+	claimants   []string // Slugs of the documents with this slug, if it is contested
 	content     string
 	children    []string // Children's slugs
+	links       []string // Slugs of documents linked in the content
+	backlinks   []string // Slugs of documents which link to this one
+}
+
+// hosts returns the slugs of the documents which have the document among their
+// children: the host from the first line of the file, followed by the hosts
+// from the `also-in` header. The root document has no hosts.
+func (doc document) hosts() []string {
+	var hosts []string
+	if doc.host != doc.slug {
+		hosts = append(hosts, doc.host)
+	}
+	return append(hosts, doc.alsoIn...)
 }
 
 func (host document) addChild(slug string) document {
@@ -138,6 +177,47 @@ func (host document) addChild(slug string) document {
 	return host
 }
 
+func (host document) removeChild(slug string) document {
+	for i, child := range host.children {
+		if child == slug {
+			host.children = append(host.children[:i:i], host.children[i+1:]...)
+			return host
+		}
+	}
+	return host
+}
+
+func (target document) addBacklink(slug string) document {
+	for _, b := range target.backlinks {
+		if b == slug {
+			return target
+		}
+	}
+	target.backlinks = append(target.backlinks, slug)
+	return target
+}
+
+func (target document) removeBacklink(slug string) document {
+	for i, b := range target.backlinks {
+		if b == slug {
+			target.backlinks = append(target.backlinks[:i:i], target.backlinks[i+1:]...)
+			return target
+		}
+	}
+	return target
+}
+
+// rootDocument returns the document which is used as the root if no file defines it.
+func rootDocument() document {
+	return document{title: "🌱", content: "# Manesei"}
+}
+
+// placeholderDocument returns the document which is used in place
+// of a host which is referenced by other documents but doesn't exist.
+func placeholderDocument(slug string) document {
+	return document{slug: slug, title: title(slug), content: "# " + title(slug)}
+}
+
 // title returns the given string with the first character converted to title case
 func title(str string) string {
 	if len(str) < 1 {
@@ -149,6 +229,48 @@ func title(str string) string {
 // addDocument parses the docFile and adds the document to the documents map.
 // The return value is of course the same as the argument, so it can be ignored.
 func addDocument(docFile docFile, documents map[string]document) map[string]document {
+	insertDocument(docFile, documents)
+	return documents
+}
+
+// parseFile parses a single docFile, without connecting it to other documents.
+func parseFile(docFile docFile) document {
+	documents := make(map[string]document, 1)
+	return documents[insertDocument(docFile, documents)]
+}
+
+// claimantSeparator separates the contested slug from the id of
+// the document in the slugs of documents with the same slug.
+const claimantSeparator = "~"
+
+// claimantSlug returns the slug of a document whose slug is contested. It
+// depends only on the document, so it doesn't change when others are added.
+func claimantSlug(slug, id string) string {
+	return slug + claimantSeparator + id
+}
+
+// contestSlug moves the document with the slug to its claimant slug and
+// puts a page listing the documents with the slug in its place. The
+// document must not be connected to other documents yet.
+func contestSlug(documents map[string]document, slug string) {
+	d := documents[slug]
+	d.isDuplicate = true
+	d.duplicateOf = slug
+	d.slug = claimantSlug(slug, d.id)
+	documents[d.slug] = d
+	contested := placeholderDocument(slug)
+	if slug == "" {
+		contested = rootDocument()
+	}
+	contested.claimants = []string{d.slug}
+	documents[slug] = contested
+}
+
+// insertDocument parses the docFile, adds the document to the documents
+// map and returns its slug. If other documents have the same slug, every
+// one of them gets a slug derived from its id, see claimantSlug, and the
+// slug from the file leads to a page listing them.
+func insertDocument(docFile docFile, documents map[string]document) string {
 	doc := document{}
 	lines := strings.Split(docFile.Body, "\n")
 	head := strings.SplitN(lines[0], " ", 2)
@@ -157,23 +279,25 @@ func addDocument(docFile docFile, documents map[string]document) map[string]docu
 	// Slug is used as the title if missing.
 	head = append(head, hostSlug[1])
 	doc.slug = hostSlug[1]
-	if d, ok := documents[doc.slug]; ok {
-		if d.id != "" && d.id != docFile.Id {
-			// An exactly named document already exists. The slug
-			// of the current name is changed and the original
-			// slug is saved in the `duplicateOf` field.
-			doc.isDuplicate = true
-			doc.duplicateOf = doc.slug
-			doc.slug += "-duplicate"
-			for d, ok := documents[doc.slug]; ok && d.id != "" && d.id != docFile.Id; d, ok = documents[doc.slug] {
-				doc.slug += string("abcdefghijklmnopqrstuvwxyz"[rand.Intn(26)])
-			}
-		} else {
-			// The document was already added, for example
-			// it was mentioned as the host of another document.
-			doc = documents[doc.slug]
+	if d, ok := documents[doc.slug]; ok && d.id != "" && d.id != docFile.Id {
+		contestSlug(documents, doc.slug)
+	}
+	if contested := documents[doc.slug]; len(contested.claimants) != 0 {
+		doc.isDuplicate = true
+		doc.duplicateOf = doc.slug
+		doc.slug = claimantSlug(doc.slug, docFile.Id)
+		if !contains(contested.claimants, doc.slug) {
+			contested.claimants = append(contested.claimants, doc.slug)
+			sort.Strings(contested.claimants)
+			documents[doc.duplicateOf] = contested
 		}
 	}
+	if d, ok := documents[doc.slug]; ok {
+		// The document was already added, for example
+		// it was mentioned as the host of another document.
+		doc.children = d.children
+		doc.backlinks = d.backlinks
+	}
 	doc.id = docFile.Id
 	doc.host = hostSlug[0]
 	doc.title = head[1]
@@ -202,16 +326,24 @@ func addDocument(docFile docFile, documents map[string]document) map[string]docu
 		}
 		doc.headers[strings.TrimSpace(h[0])] = strings.TrimSpace(h[1])
 	}
+	doc.tags = parseTags(doc.headers["tags"])
+	doc.alsoIn = nil
+	for _, host := range headerList(doc.headers["also-in"]) {
+		if host != doc.host && host != doc.slug && !contains(doc.alsoIn, host) {
+			doc.alsoIn = append(doc.alsoIn, host)
+		}
+	}
 	doc.content = strings.Join(lines[counter:], "\n")
+	doc.links = documentLinks(doc.content)
 
 	documents[doc.slug] = doc
 
-	return documents
+	return doc.slug
 }
 
 func loadDocuments(docFiles []docFile) map[string]document {
 	documents := map[string]document{
-		"": {title: "🌱", content: "# Manesei"},
+		"": rootDocument(),
 	}
 
 	for _, docFile := range docFiles {
@@ -220,36 +352,55 @@ func loadDocuments(docFiles []docFile) map[string]document {
 
 	// Connections
 	for _, doc := range documents {
-		if doc.host != doc.slug {
-			if _, ok := documents[doc.host]; !ok {
+		for _, host := range doc.hosts() {
+			if _, ok := documents[host]; !ok {
 				// This way, even if the host document doesn't exist,
 				// the current document will be accessible, because
 				// the placeholder host will be a child of the root
 				// document.
-				documents[doc.host] = document{slug: doc.host, title: title(doc.host), content: "# " + title(doc.host)}
-				documents[""] = documents[""].addChild(doc.host)
+				documents[host] = placeholderDocument(host)
+				documents[""] = documents[""].addChild(host)
+			}
+			documents[host] = documents[host].addChild(doc.slug)
+		}
+	}
+
+	// Backlinks
+	for _, doc := range documents {
+		for _, target := range doc.links {
+			if t, ok := documents[target]; ok && target != doc.slug {
+				documents[target] = t.addBacklink(doc.slug)
 			}
-			documents[doc.host] = documents[doc.host].addChild(doc.slug)
 		}
 	}
 
 	// Sort children (otherwise the order in which they are displayed changes with every page refresh)
 	for _, doc := range documents {
 		sort.Strings(doc.children)
+		sort.Strings(doc.backlinks)
 	}
 
 	return documents
 }
 
+// documentLocation returns the slugs of the hosts of the document, from the
+// one below the root document, followed by its own slug. If the hosts form a
+// cycle, the path starts at the host which would repeat.
 func documentLocation(documents map[string]document, slug string) []string {
-	if documents[slug].host != slug {
-		return append(documentLocation(documents, documents[slug].host), slug)
+	var path []string
+	visited := make(map[string]bool)
+	for slug != "" && !visited[slug] {
+		visited[slug] = true
+		path = append(path, slug)
+		if documents[slug].host == slug {
+			break
+		}
+		slug = documents[slug].host
 	}
-	if slug == "" {
-		return []string{}
-	} else {
-		return []string{slug}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
 	}
+	return path
 }
 
 type breadcrumb struct {
@@ -257,30 +408,61 @@ type breadcrumb struct {
 	title string
 }
 
+// locationBreadcrumbs returns the breadcrumbs of the path to the document.
+func locationBreadcrumbs(documents map[string]document, slug string) (breadcrumbs []breadcrumb) {
+	for _, s := range documentLocation(documents, slug) {
+		d := documents[s]
+		if d.title == "" {
+			d.title = s
+		}
+		breadcrumbs = append(breadcrumbs, breadcrumb{s, d.title})
+	}
+	return
+}
+
+// slugHref returns the escaped relative URL of the document with the given slug.
+// The `./` prefix ensures that a slug is never interpreted as a URL scheme.
+func slugHref(slug string) string {
+	return template.HTMLEscapeString("./" + slug)
+}
+
+// fileLink returns a link to the document with the given slug, styled as a file.
+func fileLink(slug, title string) template.HTML {
+	return template.HTML(`<a class="file" href="` + slugHref(slug) + `">` + template.HTMLEscapeString(title) + `</a>`)
+}
+
 func breadcrumbsHTML(breadcrumbs []breadcrumb) template.HTML {
-	str := `<a class="root" href="/n/">🌱</a>`
+	str := `<a class="root" href="` + template.HTMLEscapeString(appPath("/n/")) + `">🌱</a>`
 	for _, b := range breadcrumbs {
-		str += ` / <a href="` + b.slug + `">` + b.title + `</a>`
+		str += ` / <a href="` + slugHref(b.slug) + `">` + template.HTMLEscapeString(b.title) + `</a>`
 	}
 	return template.HTML(str)
 }
 
-func documentViewer(slug string) template.HTML {
-	documents := loadDocuments(loadFiles())
+func documentViewer(slug string, v visitor) template.HTML {
+	docIndex.RLock()
+	defer docIndex.RUnlock()
+	documents := docIndex.documents
 	doc, exists := documents[slug]
-	if !exists {
+	if !exists || !v.canRead(documents, slug) {
 		return template.HTML(createPage("Manesei",
-			template.HTML(`<header><div class="path"><a class="root" href="/n/">🌱</a></div></header>
-				<main><h2>This document does not exist.</h2></main>`)))
+			`<header><div class="path">`+breadcrumbsHTML(nil)+`</div></header>
+				<main><h2>This document does not exist.</h2></main>`))
 	}
-	path := documentLocation(documents, doc.slug)
-	var breadcrumbs []breadcrumb
-	for _, slug := range path {
-		d := documents[slug]
-		if d.title == "" {
-			d.title = slug
+	return documentPage(documents, doc, v, false)
+}
+
+// documentPage renders the page of a document, listing only the documents
+// which the visitor may read. Static pages don't contain the controls
+// which require the server.
+func documentPage(documents map[string]document, doc document, v visitor, static bool) template.HTML {
+	// The breadcrumbs follow the primary hosts, the
+	// paths through the other hosts are shown below.
+	var alsoIn []template.HTML
+	for _, host := range doc.alsoIn {
+		if v.canRead(documents, host) {
+			alsoIn = append(alsoIn, breadcrumbsHTML(locationBreadcrumbs(documents, host)))
 		}
-		breadcrumbs = append(breadcrumbs, breadcrumb{slug, d.title})
 	}
 
 	var headerBuilder strings.Builder
@@ -288,21 +470,39 @@ func documentViewer(slug string) template.HTML {
 		&headerBuilder,
 		"header.html",
 		struct {
-			Path template.HTML
-			Id   string
-			Slug string
-		}{breadcrumbsHTML(breadcrumbs), doc.id, doc.slug},
+			Path   template.HTML
+			AlsoIn []template.HTML
+			Id     string
+			Slug   string
+			Static bool
+		}{breadcrumbsHTML(locationBreadcrumbs(documents, doc.slug)), alsoIn, doc.id, doc.slug, static},
 	)
 	if err != nil {
 		panic(appError{Err: err, Description: "Failed to generate page header"})
 	}
 
-	viewer := "<main>" + parseDocument(doc.content) + "</main>"
+	content := withTags(parseDocumentWith(doc.content, queryTable(documents, v)), doc.tags, static)
+	if len(doc.claimants) != 0 {
+		// The slug is contested, see insertDocument.
+		content += template.HTML(`<p>Several notes have the slug <b>` + template.HTMLEscapeString(doc.slug) + `</b>:</p><ul class="links">`)
+		for _, slug := range doc.claimants {
+			if v.canRead(documents, slug) {
+				content += `<li>` + fileLink(slug, documents[slug].title) + `</li>`
+			}
+		}
+		content += `</ul>`
+	}
+	viewer := "<main>" + content + "</main>"
+	if doc.slug == "" {
+		viewer += tagCloudHTML(tagCounts(documents, v), static)
+	}
 
 	var simpleChildren []string // Child documents without children
 	var children []string       // Child documents with children
 	for _, slug := range doc.children {
-		if len(documents[slug].children) == 0 {
+		if !v.canRead(documents, slug) {
+			continue
+		} else if len(documents[slug].children) == 0 {
 			simpleChildren = append(simpleChildren, slug)
 		} else {
 			children = append(children, slug)
@@ -312,33 +512,78 @@ func documentViewer(slug string) template.HTML {
 	if len(simpleChildren) != 0 {
 		links += template.HTML(`<ul class="links">`)
 		for _, slug := range simpleChildren {
-			links += template.HTML(`<li><a class="file" href="` + slug + `">` + documents[slug].title + `</a></li>`)
+			links += `<li>` + fileLink(slug, documents[slug].title) + `</li>`
 		}
 		links += `</ul>`
 	}
 	if len(children) != 0 {
 		for _, slug := range children {
-			links += template.HTML(`<a class="file" href="` + slug + `">` + documents[slug].title + `</a><ul class="links">`)
+			links += fileLink(slug, documents[slug].title) + `<ul class="links">`
 			for _, child := range documents[slug].children {
-				links += template.HTML(`<li><a class="file" href="` + child + `">` + documents[child].title + `</a></li>`)
+				if v.canRead(documents, child) {
+					links += `<li>` + fileLink(child, documents[child].title) + `</li>`
+				}
 			}
 			links += `</ul>`
 		}
 	}
+	var backlinks []string
+	for _, slug := range doc.backlinks {
+		if v.canRead(documents, slug) {
+			backlinks = append(backlinks, slug)
+		}
+	}
+	if len(backlinks) != 0 {
+		links += template.HTML(`<div class="backlinks">Linked from</div><ul class="links">`)
+		for _, slug := range backlinks {
+			links += `<li>` + fileLink(slug, documents[slug].title) + `</li>`
+		}
+		links += `</ul>`
+	}
 
-	id := template.HTML(`<p style="margin-top: 64px;" class="docId">(` + doc.id + `)</p>`)
-	if doc.id == "" {
+	id := template.HTML(`<p style="margin-top: 64px;" class="docId">(` + template.HTMLEscapeString(doc.id) + `)</p>`)
+	if len(doc.claimants) != 0 {
+		id = template.HTML("")
+	} else if doc.id == "" && doc.slug != "" {
+		// The document is a placeholder for a missing host.
+		notice := `<p style="margin-top: 64px;" class="docId">This note doesn't exist, it only holds the notes which have it as their host.`
+		if !static {
+			notice += ` Deleted notes can be restored from the <a href="` + template.HTMLEscapeString(appPath("/trash/")) + `">trash</a>.`
+		}
+		id = template.HTML(notice + `</p>`)
+	} else if doc.id == "" {
 		id = template.HTML("")
 	}
 
 	return template.HTML(createPage("Manesei: "+doc.title,
 		template.HTML(headerBuilder.String())+viewer+links+id))
-	// TODO: automatically update links on rename..., file format, backlinks, related documents
+	// TODO: file format, related documents
+}
+
+// claimantTarget returns the current slug of the document whose claimant slug
+// is given, if the document doesn't have that slug anymore because its slug
+// isn't contested, so that the claimant slugs keep working.
+func (idx *documentIndex) claimantTarget(slug string) (string, bool) {
+	idx.RLock()
+	defer idx.RUnlock()
+	if _, ok := idx.documents[slug]; ok {
+		return "", false
+	}
+	i := strings.LastIndex(slug, claimantSeparator)
+	if i == -1 {
+		return "", false
+	}
+	current, ok := idx.slugs[slug[i+len(claimantSeparator):]]
+	return current, ok
 }
 
 func serveViewer() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		page := documentViewer(r.URL.Path)
+		if current, ok := docIndex.claimantTarget(r.URL.Path); ok {
+			http.Redirect(w, r, appPath("/n/"+current), http.StatusFound)
+			return
+		}
+		page := documentViewer(r.URL.Path, requestVisitor(r))
 		w.Write([]byte(page))
 	})
 }
@@ -359,7 +604,8 @@ func redirectNoteId() http.Handler {
 			}
 			docs := addDocument(docFile{argument, string(bytes)}, make(map[string]document, 1))
 			for _, d := range docs { // `docs` should contain only one document.
-				http.Redirect(w, r, "/n/"+d.slug, http.StatusFound)
+				requireAllowed(requestVisitor(r), d, false) // The slug of a private note is not revealed.
+				http.Redirect(w, r, appPath("/n/"+d.slug), http.StatusFound)
 			}
 		}
 	})
@@ -373,10 +619,26 @@ type documentForm struct {
 	Title   string
 	Headers string // JSON map[string]string
 	Body    string
+	Summary string      // Description of the changes
+	Base    string      // Version which was current when the form was loaded, see currentToken
+	Live    bool        // The current version is edited together with others, see collab.go
+	Fields  []formField // Inputs for the headers declared by the hosts, see schema.go
+}
+
+// writeEditor responds with the editor page.
+func writeEditor(w http.ResponseWriter, status int, data documentForm) {
+	var pageBuilder strings.Builder
+	err := templates.ExecuteTemplate(&pageBuilder, "editor.html", data)
+	if err != nil {
+		panic(appError{Err: err, Description: "Failed to generate editor page"})
+	}
+	w.WriteHeader(status)
+	w.Write([]byte(createPage("Manesei (edit)", template.HTML(pageBuilder.String()))))
 }
 
 func serveEditor() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requireWritable()
 		edit := strings.HasPrefix(r.URL.Path, "/edit/")
 		var argument string
 		if edit {
@@ -389,6 +651,7 @@ func serveEditor() http.Handler {
 			var data documentForm
 
 			if edit {
+				requireAccess(r, argument, true)
 				var doc document
 
 				// If URL query parameter `v` is set, then it will be used as the generation
@@ -398,7 +661,7 @@ func serveEditor() http.Handler {
 				generation, _ := strconv.ParseUint(r.URL.Query().Get("v"), 10, 64)
 				f, err := docs.Open(argument, generation)
 				if errors.Is(err, os.ErrNotExist) { // File does not exist.
-					http.Redirect(w, r, "/new/", http.StatusTemporaryRedirect)
+					http.Redirect(w, r, appPath("/new/"), http.StatusTemporaryRedirect)
 					return
 				} else if err != nil {
 					panic(appError{Err: err, Description: "Failed to open document"})
@@ -414,6 +677,11 @@ func serveEditor() http.Handler {
 				}
 				defer f.Close()
 
+				// The declared headers get their own inputs.
+				if doc.headers == nil {
+					doc.headers = make(map[string]string)
+				}
+				fields, _ := schemaFields(doc.host, doc.headers, false)
 				headers, err := json.Marshal(doc.headers)
 				if err != nil {
 					panic(err)
@@ -425,17 +693,19 @@ func serveEditor() http.Handler {
 					doc.title,
 					string(headers),
 					doc.content,
+					"",
+					currentToken(argument),
+					generation == 0 && !config.readOnly,
+					fields,
 				}
 			} else { // New document
+				requireHostAccess(r, argument)
 				data.Host = argument
+				data.Slug = r.URL.Query().Get("slug") // Suggested by the health page
+				data.Fields, _ = schemaFields(argument, map[string]string{}, false)
 			}
 
-			var pageBuilder strings.Builder
-			err := templates.ExecuteTemplate(&pageBuilder, "editor.html", data)
-			if err != nil {
-				panic(appError{Err: err, Description: "Failed to generate editor page"})
-			}
-			w.Write([]byte(createPage("Manesei (edit)", template.HTML(pageBuilder.String()))))
+			writeEditor(w, http.StatusOK, data)
 		case http.MethodPost:
 			data := documentForm{
 				r.PostFormValue("Id"),
@@ -444,38 +714,111 @@ func serveEditor() http.Handler {
 				r.PostFormValue("Title"),
 				r.PostFormValue("Headers"),
 				r.PostFormValue("Body"),
+				r.PostFormValue("Summary"),
+				r.PostFormValue("Base"),
+				false,
+				nil,
 			}
+			if data.Id != "" {
+				requireAccess(r, data.Id, true)
+			}
+			requireHostAccess(r, data.Host)
 
-			headersStr := ""
-
+			headers := make(map[string]string)
 			if data.Headers != "" {
-				var headers map[string]string
 				err := json.Unmarshal([]byte(data.Headers), &headers)
 				if err != nil {
 					panic(appError{Err: err, Description: "Failed to parse document headers"})
 				}
+			}
+			postedFields(r, data.Host, headers)
+			headersJSON, err := json.Marshal(headers)
+			if err != nil {
+				panic(err)
+			}
+			data.Headers = string(headersJSON)
+
+			// The headers declared for the documents below the host are checked,
+			// and the editor is shown again with the errors if they are invalid.
+			rest := make(map[string]string, len(headers))
+			for k, v := range headers {
+				rest[k] = v
+			}
+			if fields, valid := schemaFields(data.Host, rest, true); !valid {
+				restJSON, err := json.Marshal(rest)
+				if err != nil {
+					panic(err)
+				}
+				data.Headers = string(restJSON)
+				data.Fields = fields
+				writeEditor(w, http.StatusUnprocessableEntity, data)
+				return
+			}
 
-				for k, v := range headers {
-					headersStr += k + ": " + v + "\n"
+			// The document might have been saved by someone else since the form was loaded.
+			// Nothing else is saved from the editor between the check and the write.
+			if data.Id != "" {
+				defer lockDocument(data.Id)()
+			}
+			if _, exists := docIndex.slug(data.Id); exists && data.Base != "" && data.Base != currentToken(data.Id) {
+				serveConflict(w, data)
+				return
+			}
+
+			// If the slug of an existing document changes, the documents which refer
+			// to it can be updated. The user is first asked to confirm the changes.
+			oldSlug, renamed := docIndex.slug(data.Id)
+			renamed = renamed && oldSlug != data.Slug
+			var references []reference
+			if renamed {
+				references = docIndex.references(oldSlug, data.Id, requestVisitor(r))
+			}
+			updateReferences := r.PostFormValue("References") == "update"
+			if len(references) != 0 && r.PostFormValue("References") == "" {
+				var pageBuilder strings.Builder
+				err := templates.ExecuteTemplate(&pageBuilder, "rename.html", struct {
+					documentForm
+					OldSlug    string
+					References []reference
+				}{data, oldSlug, references})
+				if err != nil {
+					panic(appError{Err: err, Description: "Failed to generate rename page"})
 				}
+				w.Write([]byte(createPage("Manesei (rename)", template.HTML(pageBuilder.String()))))
+				return
+			}
+			if renamed && updateReferences {
+				// Links from the document to itself
+				data.Body = replaceLinks(data.Body, oldSlug, data.Slug)
+			}
+
+			headersStr := ""
+			for k, v := range headers {
+				headersStr += k + ": " + v + "\n"
 			}
 
 			fileStr := data.Host + ":" + data.Slug + " " + data.Title + "\n" + headersStr + "\n" + data.Body
 
 			if _, err := docs.Stat(data.Id, false); data.Id == "" || errors.Is(err, atylar.ErrIllegalPath) || errors.Is(err, os.ErrNotExist) {
 				// New, random identifier
-				data.Id = strings.ReplaceAll(uuid.NewString(), ":", "-")
+				data.Id = newDocumentId()
 			}
-			file, err := docs.Write(data.Id)
-			if err != nil {
-				panic(appError{Err: err, Description: "Failed to open file"})
-			}
-			defer file.Close()
-			if _, err := file.WriteString(fileStr); err != nil {
-				panic(appError{Err: err, Description: "Failed to write file"})
+			writeRevision(docFile{Id: data.Id, Body: fileStr}, requestUser(r), data.Summary)
+
+			if updateReferences {
+				for _, ref := range references {
+					if f, ok := docIndex.file(ref.Id); ok {
+						body := rewriteReferences(f.Body, oldSlug, data.Slug)
+						writeRevision(docFile{Id: f.Id, Body: body}, requestUser(r), "Renamed "+oldSlug+" to "+data.Slug)
+					}
+				}
 			}
 
-			w.Header().Set("Location", "/n/"+data.Slug)
+			location := data.Slug
+			if slug, ok := docIndex.slug(data.Id); ok {
+				location = slug // Differs if the slug is contested
+			}
+			w.Header().Set("Location", appPath("/n/"+location))
 			w.WriteHeader(http.StatusSeeOther)
 		default:
 			panic(appError{Description: "Unsupported HTTP method"})
@@ -488,6 +831,12 @@ func serveHistory() http.Handler {
 		arguments := append(strings.Split(strings.TrimPrefix(r.URL.Path, "/history/"), "/"), "current")
 		id := arguments[0]
 		revision := arguments[1]
+		requireAccess(r, id, false)
+
+		if strings.Contains(revision, "..") {
+			serveDiff(w, r, id, revision)
+			return
+		}
 
 		revisions, err := docs.FileHistory(id)
 		if err != nil {
@@ -497,6 +846,21 @@ func serveHistory() http.Handler {
 		for _, rev := range revisions {
 			revisionsStr = append(revisionsStr, strconv.FormatUint(rev, 10))
 		}
+		infos := revisionInfos(id, revisionsStr)
+		var selected revisionInfo
+		for _, info := range infos {
+			if info.Revision == revision {
+				selected = info
+			}
+		}
+
+		// The revision preceding the selected one
+		var previous string
+		for i, rev := range revisionsStr[:len(revisionsStr)-1] {
+			if rev == revision {
+				previous = revisionsStr[i+1]
+			}
+		}
 
 		var viewer template.HTML
 		var doc document
@@ -536,10 +900,12 @@ func serveHistory() http.Handler {
 			Slug      string
 			Link      string
 			Id        string
-			Revisions []string
+			Revisions []revisionInfo
 			Revision  string
+			Selected  revisionInfo
+			Previous  string
 			Viewer    template.HTML
-		}{doc.title, doc.slug, linkText, id, revisionsStr, revision, viewer})
+		}{doc.title, doc.slug, linkText, id, infos, revision, selected, previous, viewer})
 		if err != nil {
 			panic(appError{Err: err, Description: "Failed to generate editor page"})
 		}
@@ -548,18 +914,54 @@ func serveHistory() http.Handler {
 }
 
 func main() {
-	var err error
+	args, err := parseConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "manesei:", err)
+		os.Exit(2)
+	}
 	if docs, err = atylar.New(dataDirectory); err != nil {
-		log.Fatal("Couldn't init storage.")
+		fmt.Fprintln(os.Stderr, "manesei: couldn't initialize the storage in the data directory:", err)
+		os.Exit(1)
 	}
+	docIndex = newDocumentIndex(loadFiles())
 
-	http.Handle("/", errorHandler(http.RedirectHandler("/n/", http.StatusTemporaryRedirect)))
-	http.Handle("/fonts/", http.FileServer(http.FS(fontsFS)))
-	http.Handle("/n/", http.StripPrefix("/n/", errorHandler(serveViewer())))        // /note/slug
-	http.Handle("/nid/", http.StripPrefix("/nid/", errorHandler(redirectNoteId()))) // /nid/id Redirect to note by id instead of slug
-	http.Handle("/edit/", errorHandler(serveEditor()))                              // /edit/id
-	http.Handle("/new/", errorHandler(serveEditor()))                               // /new/host
-	http.Handle("/history/", errorHandler(serveHistory()))                          // /history/id/revision
+	if len(args) > 0 {
+		if err := runCommand(args[0], args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	log.Fatal(http.ListenAndServe(":8000", nil))
+	if config.users != "" {
+		if users, err = loadUsers(config.users); err != nil {
+			fmt.Fprintln(os.Stderr, "manesei: couldn't load the users:", err)
+			os.Exit(1)
+		} else if len(users) == 0 {
+			fmt.Fprintln(os.Stderr, "manesei: there are no users in "+config.users+", add one with the adduser command")
+			os.Exit(1)
+		}
+	}
+
+	http.Handle("/", errorHandler(http.RedirectHandler(appPath("/n/"), http.StatusTemporaryRedirect)))
+	http.Handle("/fonts/", http.FileServer(http.FS(fontsFS)))
+	http.Handle("/n/", http.StripPrefix("/n/", errorHandler(public(serveViewer()))))              // /note/slug
+	http.Handle("/nid/", http.StripPrefix("/nid/", errorHandler(public(redirectNoteId()))))       // /nid/id Redirect to note by id instead of slug
+	http.Handle("/edit/", errorHandler(authenticated(serveEditor())))                             // /edit/id
+	http.Handle("/new/", errorHandler(authenticated(serveEditor())))                              // /new/host
+	http.Handle("/history/", errorHandler(authenticated(serveHistory())))                         // /history/id/revision
+	http.Handle("/delete/", errorHandler(authenticated(serveDelete())))                           // /delete/id
+	http.Handle("/trash/", errorHandler(authenticated(serveTrash())))                             // /trash/id
+	http.Handle("/search", errorHandler(public(serveSearch())))                                   // /search?q=query
+	http.Handle("/api/", http.StripPrefix("/api", apiErrorHandler(apiAuthenticated(serveAPI())))) // /api/documents/...
+	http.Handle("/login", errorHandler(serveLogin()))                                             // /login?next=path
+	http.Handle("/collab/", errorHandler(authenticated(serveCollab())))                           // /collab/id WebSocket for editing together
+	http.Handle("/logout", errorHandler(serveLogout()))                                           // /logout
+	http.Handle("/events/", errorHandler(public(serveEvents())))                                  // /events/slug Changes of a note
+	http.Handle("/tag/", errorHandler(public(serveTag())))                                        // /tag/name
+	http.Handle("/health", errorHandler(authenticated(serveHealth())))                            // /health
+
+	go watchFiles()
+	log.Fatal(http.ListenAndServe(config.listen, withBase(http.DefaultServeMux)))
 }
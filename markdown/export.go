@@ -0,0 +1,313 @@
+// Package markdown converts documents between the markup used by Manesei
+// and CommonMark (with the strikethrough extension).
+//
+// The markup of Manesei is similar to Markdown, but links are written as
+// `{target text}`, ordered list elements start with `. `, superscript,
+// subscript and highlight are written as `^x^`, `~x~` and `==x==` and every
+// newline is significant. Constructs which don't have an equivalent in
+// CommonMark are converted to inline HTML.
+package markdown
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// escapable contains characters which are written literally
+// in Manesei's markup when preceded by a backslash.
+const escapable = "\\`{}*~=^"
+
+// infoString matches words which are kept after the fence of a code block.
+var infoString = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_+#.-]*$`)
+
+// indentation returns the number of leading spaces and tabs of the line.
+func indentation(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " \t"))
+}
+
+// listLevel describes an open list while converting.
+type listLevel struct {
+	indent int // Indentation of the list in the source
+	column int // Indentation of the list in the output
+	width  int // Width of the list marker in the output
+}
+
+// ToMarkdown converts a document written in Manesei's markup to CommonMark.
+// The link function maps targets of `{}` links to URLs. If it is nil,
+// targets are used unchanged.
+func ToMarkdown(document string, link func(target string) string) string {
+	if link == nil {
+		link = identity
+	}
+	lines := strings.Split(document, "\n")
+	var out []string
+	var lists []listLevel
+	quote := false       // The previous line was a block quote.
+	paragraph := false   // The previous line was a paragraph.
+	code := false        // Inside a code block
+	codeIndent := 0      // Indentation of the code block's fence in the source
+	codeColumn := 0      // Indentation of the code block in the output
+	endBlock := func() { // Separates a list or a quote from the following text.
+		if len(lists) != 0 || quote {
+			out = append(out, "")
+		}
+		lists = nil
+		quote = false
+		paragraph = false
+	}
+	hardBreak := func() { // Preserves the newline at the end of the previous paragraph line.
+		if paragraph {
+			out[len(out)-1] += "\\"
+		}
+		paragraph = false
+	}
+
+	for _, line := range lines {
+		if code {
+			n := indentation(line)
+			if n > codeIndent {
+				n = codeIndent
+			}
+			line = line[n:]
+			out = append(out, strings.Repeat(" ", codeColumn)+line)
+			if strings.HasPrefix(line, "```") {
+				code = false
+			}
+			continue
+		}
+
+		n := indentation(line)
+		rest := line[n:]
+		column := 0 // Indentation in the output
+
+		if len(lists) != 0 {
+			if strings.HasPrefix(rest, "- ") || strings.HasPrefix(rest, ". ") {
+				for len(lists) != 0 && n < lists[len(lists)-1].indent {
+					lists = lists[:len(lists)-1]
+				}
+				if len(lists) == 0 || n > lists[len(lists)-1].indent {
+					column := 0
+					if len(lists) != 0 {
+						column = lists[len(lists)-1].column + lists[len(lists)-1].width
+					}
+					lists = append(lists, listLevel{indent: n, column: column})
+				}
+				out = append(out, listItem(&lists[len(lists)-1], rest, link))
+				paragraph = true
+				continue
+			} else if n > lists[len(lists)-1].indent && strings.TrimSpace(rest) != "" {
+				// Continuation of the list element
+				top := lists[len(lists)-1]
+				column = top.column + top.width
+			} else if strings.TrimSpace(rest) != "" {
+				endBlock()
+			}
+		} else if n == 0 && (strings.HasPrefix(rest, "- ") || strings.HasPrefix(rest, ". ")) {
+			endBlock()
+			lists = append(lists, listLevel{})
+			out = append(out, listItem(&lists[0], rest, link))
+			paragraph = true
+			continue
+		} else {
+			rest = line
+		}
+		indent := strings.Repeat(" ", column)
+
+		switch {
+		case strings.HasPrefix(rest, "```"):
+			paragraph = false
+			if column == 0 {
+				endBlock()
+			}
+			code = true
+			codeIndent = n
+			if column == 0 {
+				codeIndent = 0
+			}
+			codeColumn = column
+			// A word after the fence, like the language of the code, is the info
+			// string, and other text after the fence is the first line of the code.
+			tail := strings.TrimPrefix(rest, "```")
+			if infoString.MatchString(tail) {
+				out = append(out, indent+"```"+tail)
+			} else {
+				out = append(out, indent+"```")
+				if tail != "" {
+					out = append(out, indent+tail)
+				}
+			}
+		case strings.HasPrefix(rest, "> "):
+			paragraph = false
+			if !quote && column == 0 {
+				endBlock()
+			}
+			if quote {
+				out[len(out)-1] += "\\"
+			}
+			quote = true
+			out = append(out, indent+"> "+inline(rest[2:], link))
+		case strings.HasPrefix(rest, "#") && strings.HasPrefix(strings.TrimLeft(rest, "#"), " "):
+			paragraph = false
+			if column == 0 {
+				endBlock()
+			}
+			level := len(rest) - len(strings.TrimLeft(rest, "#"))
+			if level > 6 {
+				level = 6
+			}
+			out = append(out, indent+strings.Repeat("#", level)+" "+inline(strings.TrimLeft(rest, "#")[1:], link))
+		case strings.HasPrefix(rest, "---"):
+			paragraph = false
+			if column == 0 {
+				endBlock()
+			}
+			out = append(out, indent+"***")
+			if tail := strings.TrimPrefix(rest, "---"); strings.TrimSpace(tail) != "" {
+				out = append(out, indent+inline(tail, link))
+				paragraph = true
+			}
+		case strings.TrimSpace(rest) == "":
+			lists = nil
+			quote = false
+			paragraph = false
+			out = append(out, "")
+		default:
+			if quote && column == 0 {
+				endBlock()
+			}
+			hardBreak()
+			out = append(out, indent+escapeLineStart(inline(strings.TrimLeft(rest, " \t"), link)))
+			paragraph = true
+		}
+	}
+	return strings.Join(out, "\n")
+}
+
+// listItem converts a line starting with a list marker and updates the list level.
+func listItem(level *listLevel, line string, link func(string) string) string {
+	marker := "- "
+	if strings.HasPrefix(line, ". ") {
+		marker = "1. "
+	}
+	level.width = len(marker)
+	return strings.Repeat(" ", level.column) + marker + inline(line[2:], link)
+}
+
+// escapeLineStart escapes the beginning of a line of text,
+// which would otherwise start a block element in CommonMark.
+func escapeLineStart(line string) string {
+	for _, prefix := range []string{"#", "> ", "- ", "+ ", "* ", "=", "```", "~~~"} {
+		if strings.HasPrefix(line, prefix) {
+			return "\\" + line
+		}
+	}
+	if digits := strings.TrimLeft(line, "0123456789"); len(digits) != len(line) &&
+		(strings.HasPrefix(digits, ". ") || strings.HasPrefix(digits, ") ")) {
+		return line[:len(line)-len(digits)] + "\\" + digits
+	}
+	return line
+}
+
+// inlineHTML maps delimiters of inline formatting without
+// an equivalent in CommonMark to HTML elements.
+var inlineHTML = map[string]string{
+	"==": "mark",
+	"~":  "sub",
+	"^":  "sup",
+}
+
+// closing returns the index of the delimiter closing the inline
+// formatting which starts at the index i, or -1 if there isn't one.
+func closing(line []rune, i int, delimiter string) int {
+	start := i + len(delimiter)
+	if start >= len(line) || unicode.IsSpace(line[start]) {
+		return -1
+	}
+	for j := start + 1; j+len(delimiter) <= len(line); j++ {
+		if string(line[j:j+len(delimiter)]) == delimiter && !unicode.IsSpace(line[j-1]) {
+			return j
+		}
+	}
+	return -1
+}
+
+// inline converts the inline elements of a line.
+func inline(text string, link func(string) string) string {
+	line := []rune(text)
+	var out strings.Builder
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && i+1 < len(line) && strings.ContainsRune(escapable, line[i+1]):
+			i++
+			switch line[i] {
+			case '{', '}', '=', '^':
+				out.WriteRune(line[i]) // Not special in CommonMark
+			default:
+				out.WriteString("\\" + string(line[i]))
+			}
+		case c == '`':
+			end := i + 1
+			for end < len(line) && line[end] != '`' {
+				end++
+			}
+			out.WriteString(string(line[i:min(end+1, len(line))]))
+			i = end
+		case c == '{':
+			end := i + 1
+			for end < len(line) && line[end] != '}' {
+				end++
+			}
+			if end == len(line) {
+				out.WriteRune(c)
+				continue
+			}
+			parts := strings.SplitN(string(line[i+1:end]), " ", 2)
+			url := link(parts[0])
+			if strings.ContainsAny(url, " ()<>") {
+				url = "<" + strings.NewReplacer("<", "%3C", ">", "%3E").Replace(url) + ">"
+			}
+			if len(parts) == 1 && strings.Contains(url, ":") && !strings.ContainsAny(url, " <>") {
+				out.WriteString("<" + url + ">") // Autolink
+			} else if len(parts) == 1 {
+				out.WriteString("[" + inline(parts[0], link) + "](" + url + ")")
+			} else {
+				out.WriteString("[" + inline(parts[1], link) + "](" + url + ")")
+			}
+			i = end
+		case string(line[i:min(i+2, len(line))]) == "==" || c == '^' || (c == '~' && string(line[i:min(i+2, len(line))]) != "~~"):
+			delimiter := string(c)
+			if c == '=' {
+				delimiter = "=="
+			}
+			if end := closing(line, i, delimiter); end != -1 {
+				tag := inlineHTML[delimiter]
+				out.WriteString("<" + tag + ">" + inline(string(line[i+len(delimiter):end]), link) + "</" + tag + ">")
+				i = end + len(delimiter) - 1
+			} else {
+				out.WriteString(strings.Repeat("\\"+string(c), len(delimiter)))
+				i += len(delimiter) - 1
+			}
+		case c == '~': // Strikethrough is the same in both
+			out.WriteString("~~")
+			i++
+		case strings.ContainsRune("[]<>_\\", c):
+			out.WriteString("\\" + string(c))
+		default:
+			out.WriteRune(c)
+		}
+	}
+	return out.String()
+}
+
+func identity(s string) string {
+	return s
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
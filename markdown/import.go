@@ -0,0 +1,369 @@
+package markdown
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+var (
+	atxHeading    = regexp.MustCompile(`^(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	thematicBreak = regexp.MustCompile(`^(?:(?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	listMarker    = regexp.MustCompile(`^(?:[-*+]|[0-9]{1,9}[.)])(?:[ \t]+|$)`)
+	entity        = regexp.MustCompile(`^&(?:#[0-9]{1,7}|#[xX][0-9a-fA-F]{1,6}|[a-zA-Z][a-zA-Z0-9]{1,31});`)
+	autolink      = regexp.MustCompile(`^<([a-zA-Z][a-zA-Z0-9+.-]{1,31}:[^<>\s]*)>`)
+)
+
+// htmlTags maps inline HTML tags to Manesei's delimiters.
+var htmlTags = map[string]string{
+	"em": "*", "i": "*",
+	"strong": "**", "b": "**",
+	"s": "~~", "del": "~~",
+	"sub": "~", "sup": "^", "mark": "==",
+}
+
+// importList describes an open list while converting.
+type importList struct {
+	source int // Indentation of the list markers in the source
+	output int // Indentation of the list markers in the output
+}
+
+// expandTabs replaces tabs in the indentation of the line with spaces.
+func expandTabs(line string) string {
+	n := indentation(line)
+	return strings.ReplaceAll(line[:n], "\t", "    ") + line[n:]
+}
+
+// FromMarkdown converts a CommonMark document to Manesei's markup. The link
+// function maps link destinations to targets of `{}` links. If it is nil,
+// destinations are used unchanged.
+func FromMarkdown(markdown string, link func(url string) string) string {
+	if link == nil {
+		link = identity
+	}
+	var out []string
+	paragraph := false     // The previous line is a paragraph which can be continued.
+	lineBreak := false     // The previous line ended with a hard line break.
+	blank := false         // The previous line was blank.
+	var lists []importList // Open lists, the innermost last
+	fence := ""            // Fence of the current code block
+	fenceIndent := 0       // Indentation of the fence in the source
+	fenceColumn := 0       // Indentation of the fence in the output
+	indentedCode := false  // Inside an indented code block
+
+	// Nested lists are indented by two spaces in the output, and the lines
+	// continuing a list element are indented like its content.
+	itemColumn := func(n int) int {
+		for i := len(lists) - 1; i >= 0; i-- {
+			if lists[i].source < n {
+				return lists[i].output + 2
+			}
+		}
+		return 0
+	}
+
+	for _, line := range strings.Split(strings.ReplaceAll(markdown, "\r\n", "\n"), "\n") {
+		line = expandTabs(line)
+		n := indentation(line)
+		rest := line[n:]
+
+		if fence != "" {
+			if n < 4 && strings.HasPrefix(rest, fence) && strings.Trim(rest, fence[:1]+" ") == "" {
+				out = append(out, strings.Repeat(" ", fenceColumn)+"```")
+				fence = ""
+			} else {
+				if n > fenceIndent {
+					n = fenceIndent
+				}
+				out = append(out, strings.Repeat(" ", fenceColumn)+line[n:])
+			}
+			continue
+		}
+		if indentedCode {
+			if n >= 4 || rest == "" {
+				out = append(out, strings.TrimPrefix(line, "    "))
+				continue
+			}
+			// Trailing blank lines aren't a part of the code block.
+			for len(out) != 0 && out[len(out)-1] == "" {
+				out = out[:len(out)-1]
+			}
+			out = append(out, "```", "")
+			indentedCode = false
+		}
+
+		if rest == "" {
+			out = append(out, "")
+			paragraph, lineBreak, blank = false, false, true
+			continue
+		}
+		if blank && n == 0 && !listMarker.MatchString(rest) {
+			lists = nil
+		}
+		blank = false
+		inList := len(lists) != 0 && n > lists[len(lists)-1].source
+		indent := ""
+		if inList {
+			indent = strings.Repeat(" ", itemColumn(n))
+		}
+
+		switch {
+		case n >= 4 && !paragraph && !inList:
+			indentedCode = true
+			out = append(out, "```", line[4:])
+		case n < 4 && (strings.HasPrefix(rest, "```") || strings.HasPrefix(rest, "~~~")):
+			fence = rest[:len(rest)-len(strings.TrimLeft(rest, rest[:1]))]
+			fenceIndent, fenceColumn = n, len(indent)
+			if !inList {
+				fenceIndent = 0
+			}
+			// The info string, like the language of the code, is kept after the fence.
+			info := strings.TrimSpace(strings.TrimLeft(rest, fence[:1]))
+			out = append(out, indent+"```"+info)
+		case paragraph && !lineBreak && strings.Trim(rest, "= ") == "" && strings.HasPrefix(rest, "="):
+			out[len(out)-1] = "# " + strings.TrimLeft(out[len(out)-1], " ")
+			paragraph = false
+		case paragraph && !lineBreak && strings.Trim(rest, "- ") == "" && strings.HasPrefix(rest, "-"):
+			out[len(out)-1] = "## " + strings.TrimLeft(out[len(out)-1], " ")
+			paragraph = false
+		case thematicBreak.MatchString(rest):
+			out = append(out, "---")
+			paragraph = false
+		case atxHeading.MatchString(rest):
+			m := atxHeading.FindStringSubmatch(rest)
+			out = append(out, m[1]+" "+inlineFrom(m[2], link))
+			paragraph = false
+		case strings.HasPrefix(rest, ">"):
+			for strings.HasPrefix(rest, ">") { // Nested quotes are flattened.
+				rest = strings.TrimPrefix(strings.TrimPrefix(rest, ">"), " ")
+			}
+			text, hardBreak := trimLineBreak(rest)
+			if strings.TrimSpace(text) == "" {
+				out = append(out, indent+">")
+				paragraph = false
+			} else if paragraph && !lineBreak && strings.HasPrefix(strings.TrimLeft(out[len(out)-1], " "), "> ") {
+				out[len(out)-1] += " " + inlineFrom(text, link)
+			} else {
+				out = append(out, indent+"> "+inlineFrom(text, link))
+				paragraph = true
+			}
+			lineBreak = hardBreak
+		case listMarker.MatchString(rest):
+			marker := "- "
+			if unicode.IsDigit(rune(rest[0])) {
+				marker = ". "
+			}
+			text, hardBreak := trimLineBreak(strings.TrimLeft(rest[len(listMarker.FindString(rest)):], " "))
+			for len(lists) != 0 && lists[len(lists)-1].source > n {
+				lists = lists[:len(lists)-1]
+			}
+			if len(lists) == 0 || lists[len(lists)-1].source < n {
+				lists = append(lists, importList{n, itemColumn(n)})
+			}
+			out = append(out, strings.Repeat(" ", lists[len(lists)-1].output)+marker+inlineFrom(text, link))
+			paragraph, lineBreak = true, hardBreak
+		default:
+			text, hardBreak := trimLineBreak(rest)
+			if paragraph && !lineBreak { // Soft line break
+				out[len(out)-1] += " " + inlineFrom(text, link)
+			} else {
+				out = append(out, indent+inlineFrom(text, link))
+			}
+			paragraph, lineBreak = true, hardBreak
+		}
+	}
+	if indentedCode {
+		for len(out) != 0 && out[len(out)-1] == "" {
+			out = out[:len(out)-1]
+		}
+		out = append(out, "```")
+	}
+	return strings.Join(out, "\n")
+}
+
+// trimLineBreak removes a hard line break from the end of the line.
+func trimLineBreak(line string) (text string, lineBreak bool) {
+	if strings.HasSuffix(line, "\\") {
+		return strings.TrimSuffix(line, "\\"), true
+	}
+	if strings.HasSuffix(line, "  ") {
+		return strings.TrimRight(line, " "), true
+	}
+	return strings.TrimRight(line, " "), false
+}
+
+// isASCIIPunct checks if the character can be escaped in CommonMark.
+func isASCIIPunct(c rune) bool {
+	return c < unicode.MaxASCII && unicode.IsPunct(c) || strings.ContainsRune("$+<=>^`|~", c)
+}
+
+// inlineFrom converts the inline elements of a line of a CommonMark document.
+func inlineFrom(text string, link func(string) string) string {
+	line := []rune(text)
+	var out strings.Builder
+	isWordRune := func(i int) bool {
+		return i >= 0 && i < len(line) && (unicode.IsLetter(line[i]) || unicode.IsDigit(line[i]))
+	}
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		rest := string(line[i:])
+		switch {
+		case c == '\\' && i+1 < len(line) && isASCIIPunct(line[i+1]):
+			i++
+			if strings.ContainsRune(escapable, line[i]) {
+				out.WriteRune('\\')
+			}
+			out.WriteRune(line[i])
+		case c == '`':
+			run := len(rest) - len(strings.TrimLeft(rest, "`"))
+			delimiter := strings.Repeat("`", run)
+			end := strings.Index(rest[run:], delimiter)
+			if end == -1 {
+				out.WriteString(strings.Repeat("\\`", run))
+				i += run - 1
+				continue
+			}
+			code := rest[run : run+end]
+			if len(code) > 1 && code[0] == ' ' && code[len(code)-1] == ' ' {
+				code = code[1 : len(code)-1]
+			}
+			out.WriteString("`" + strings.ReplaceAll(code, "`", "'") + "`")
+			i += len([]rune(rest[:run+end+run])) - 1
+		case c == '[' || (c == '!' && strings.HasPrefix(rest, "![")):
+			start := i
+			if c == '!' {
+				start++
+			}
+			label, destination, length, ok := parseLink(line[start:])
+			if !ok {
+				out.WriteRune(c)
+				continue
+			}
+			target := strings.ReplaceAll(link(destination), " ", "%20")
+			if label == "" || label == destination || label == target {
+				out.WriteString("{" + target + "}")
+			} else {
+				out.WriteString("{" + target + " " + inlineFrom(label, link) + "}")
+			}
+			i = start + length - 1
+		case autolink.MatchString(rest):
+			m := autolink.FindStringSubmatch(rest)
+			out.WriteString("{" + link(m[1]) + "}")
+			i += len([]rune(m[0])) - 1
+		case c == '<':
+			tag := ""
+			if end := strings.IndexRune(rest, '>'); end != -1 {
+				tag = strings.ToLower(strings.Trim(rest[1:end], "/ "))
+				if delimiter, ok := htmlTags[tag]; ok {
+					out.WriteString(delimiter)
+					i += len([]rune(rest[:end+1])) - 1
+					continue
+				}
+			}
+			out.WriteRune(c)
+		case c == '&' && entity.MatchString(rest):
+			m := entity.FindString(rest)
+			out.WriteString(escapeText(html.UnescapeString(m)))
+			i += len([]rune(m)) - 1
+		case strings.HasPrefix(rest, "**") || strings.HasPrefix(rest, "__"):
+			out.WriteString("**")
+			i++
+		case c == '*':
+			out.WriteRune(c)
+		case c == '_':
+			if isWordRune(i-1) && isWordRune(i+1) { // Underscores inside words are literal.
+				out.WriteRune(c)
+			} else {
+				out.WriteRune('*')
+			}
+		case strings.HasPrefix(rest, "~~"):
+			out.WriteString("~~")
+			i++
+		case c == '=':
+			if strings.HasPrefix(rest, "==") {
+				out.WriteRune('\\')
+			}
+			out.WriteRune(c)
+		default:
+			out.WriteString(escapeText(string(c)))
+		}
+	}
+	return out.String()
+}
+
+// escapeText escapes characters which are special in Manesei's markup.
+func escapeText(text string) string {
+	var out strings.Builder
+	for _, c := range text {
+		if strings.ContainsRune("{}~^`\\", c) {
+			out.WriteRune('\\')
+		}
+		out.WriteRune(c)
+	}
+	return out.String()
+}
+
+// parseLink parses an inline link of the form [label](destination "title"),
+// returning its label, destination and length in runes.
+func parseLink(line []rune) (label, destination string, length int, ok bool) {
+	depth := 0
+	i := 0
+	for ; i < len(line); i++ {
+		if line[i] == '\\' {
+			i++
+		} else if line[i] == '[' {
+			depth++
+		} else if line[i] == ']' {
+			depth--
+			if depth == 0 {
+				break
+			}
+		}
+	}
+	if i >= len(line)-1 || line[i+1] != '(' {
+		return
+	}
+	label = string(line[1:i])
+	i += 2
+	for i < len(line) && line[i] == ' ' {
+		i++
+	}
+	start := i
+	if i < len(line) && line[i] == '<' {
+		for i < len(line) && line[i] != '>' {
+			i++
+		}
+		if i == len(line) {
+			return
+		}
+		destination = string(line[start+1 : i])
+		i++
+	} else {
+		depth = 0
+		for ; i < len(line) && line[i] != ' '; i++ {
+			if line[i] == '(' {
+				depth++
+			} else if line[i] == ')' {
+				if depth == 0 {
+					break
+				}
+				depth--
+			}
+		}
+		destination = string(line[start:i])
+	}
+	// The title is ignored.
+	for i < len(line) && line[i] != ')' {
+		if line[i] == '"' || line[i] == '\'' {
+			quote := line[i]
+			for i++; i < len(line) && line[i] != quote; i++ {
+			}
+		}
+		i++
+	}
+	if i >= len(line) {
+		return
+	}
+	return label, destination, i + 1, true
+}
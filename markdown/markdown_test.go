@@ -0,0 +1,82 @@
+package markdown
+
+import "testing"
+
+func TestRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		name, document, markdown string
+	}{
+		{"headings", "# Heading\n## Sub\n###### Deep", "# Heading\n## Sub\n###### Deep"},
+		{"paragraph", "line1\nline2", "line1\\\nline2"},
+		{"block quote", "> quote\n> more", "> quote\\\n> more"},
+		{"horizontal rule", "a\n---\nb", "a\n***\nb"},
+		{"nested list", "- a\n  - b\n    - c\n- d", "- a\n  - b\n    - c\n- d"},
+		{"ordered list", ". a\n. b\n  . c\n. d", "1. a\n1. b\n   1. c\n1. d"},
+		{"mixed list", "- a\n  . b\n  . c\n- d", "- a\n  1. b\n  1. c\n- d"},
+		{"list continuation", "- a\n  more\n- b", "- a\\\n  more\n- b"},
+		{"link", "{target text}", "[text](target)"},
+		{"link with formatting", "{target *text*}", "[*text*](target)"},
+		{"autolink", "{https://example.com}", "<https://example.com>"},
+		{"link without text", "{notes}", "[notes](notes)"},
+		{"code block", "```\ncode\n  x\n```", "```\ncode\n  x\n```"},
+		{"code block language", "```go\nfunc f() {}\n```", "```go\nfunc f() {}\n```"},
+		{"code block in list", "- a\n  ```sh\n  ls\n  ```\n- b", "- a\n  ```sh\n  ls\n  ```\n- b"},
+		{"inline code", "`a_b {c}`", "`a_b {c}`"},
+		{"emphasis", "*em* **strong** ***both*** ~~strike~~", "*em* **strong** ***both*** ~~strike~~"},
+		{"html formatting", "~sub~ a^sup^ ==mark==", "<sub>sub</sub> a<sup>sup</sup> <mark>mark</mark>"},
+		{"underscores", "a_b and _x_", "a\\_b and \\_x\\_"},
+		{"escaped caret", "\\^x\\^", "^x^"},
+		{"escaped highlight", "\\==x\\==", "\\==x=="},
+		{"escaped braces", "\\{x\\}", "{x}"},
+		{"escaped emphasis", "\\*a\\* \\`b", "\\*a\\* \\`b"},
+		{"brackets", "[a] <b>", "\\[a\\] \\<b\\>"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			markdown := ToMarkdown(test.document, nil)
+			if markdown != test.markdown {
+				t.Errorf("ToMarkdown(%q)\ngot      %q\nexpected %q", test.document, markdown, test.markdown)
+			}
+			if document := FromMarkdown(markdown, nil); document != test.document {
+				t.Errorf("FromMarkdown(%q)\ngot      %q\nexpected %q", markdown, document, test.document)
+			}
+		})
+	}
+}
+
+func TestFromMarkdown(t *testing.T) {
+	for _, test := range []struct {
+		name, markdown, document string
+	}{
+		{"setext headings", "Title\n=====\nSub\n---", "# Title\n## Sub"},
+		{"closed atx heading", "## Title ##", "## Title"},
+		{"soft line break", "a\nb", "a b"},
+		{"list markers", "* a\n+ b\n1) c", "- a\n- b\n. c"},
+		{"deep ordered list", "1. a\n   1. b\n      1. c", ". a\n  . b\n    . c"},
+		{"dedent by two levels", "- a\n  - b\n    - c\n- d", "- a\n  - b\n    - c\n- d"},
+		{"fence language", "~~~python\nprint()\n~~~", "```python\nprint()\n```"},
+		{"indented code", "    code\n\ntext", "```\ncode\n```\n\ntext"},
+		{"reference", "[text](other.md \"Title\")", "{other.md text}"},
+		{"underscore emphasis", "_em_ __strong__", "*em* **strong**"},
+		{"escapes", "\\_a\\_ \\[b\\]", "_a_ [b]"},
+		{"special characters", "{a} ~b^ ==c", "\\{a\\} \\~b\\^ \\==c"},
+		{"entities", "&amp; &lt; &#123;", "& < \\{"},
+		{"html", "<em>a</em> <sup>b</sup>", "*a* ^b^"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if document := FromMarkdown(test.markdown, nil); document != test.document {
+				t.Errorf("FromMarkdown(%q)\ngot      %q\nexpected %q", test.markdown, document, test.document)
+			}
+		})
+	}
+}
+
+func TestLinkMapping(t *testing.T) {
+	toURL := func(target string) string { return target + ".md" }
+	if markdown := ToMarkdown("{a A} {b}", toURL); markdown != "[A](a.md) [b](b.md)" {
+		t.Errorf("ToMarkdown: %q", markdown)
+	}
+	toTarget := func(url string) string { return url[:len(url)-len(".md")] }
+	if document := FromMarkdown("[A](a.md) [b](b.md)", toTarget); document != "{a A} {b}" {
+		t.Errorf("FromMarkdown: %q", document)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Markers surrounding the conflicting parts of a merged document.
+const (
+	conflictOurs   = "<<<<<<< your version"
+	conflictMiddle = "======="
+	conflictTheirs = ">>>>>>> saved version"
+)
+
+// currentToken returns a hash of the current version of the document, which
+// identifies it, or "" if the document doesn't exist. Unlike the generations,
+// it changes even if writing the document doesn't add a version to the history.
+func currentToken(id string) string {
+	body, ok := readRevision(id, 0)
+	if !ok {
+		return ""
+	}
+	return bodyHash(body)
+}
+
+// baseGeneration returns the newest generation in the history of the document
+// whose content has the given token, if the version has been replaced since.
+func baseGeneration(id string, token string) (uint64, bool) {
+	history, err := docs.FileHistory(id)
+	if err != nil {
+		return 0, false
+	}
+	for _, generation := range history {
+		if body, ok := readRevision(id, generation); ok && bodyHash(body) == token {
+			return generation, true
+		}
+	}
+	return 0, false
+}
+
+// documentLocks holds a lock for every document being saved from the editor, so
+// that no other version is saved between checking for changes and writing.
+var documentLocks = struct {
+	sync.Mutex
+	locks map[string]*documentLock
+}{locks: make(map[string]*documentLock)}
+
+type documentLock struct {
+	sync.Mutex
+	users int // Requests holding or waiting for the lock
+}
+
+// lockDocument locks the document with the given id and returns a function unlocking it.
+func lockDocument(id string) (unlock func()) {
+	documentLocks.Lock()
+	l, ok := documentLocks.locks[id]
+	if !ok {
+		l = &documentLock{}
+		documentLocks.locks[id] = l
+	}
+	l.users++
+	documentLocks.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		documentLocks.Lock()
+		if l.users--; l.users == 0 {
+			delete(documentLocks.locks, id)
+		}
+		documentLocks.Unlock()
+	}
+}
+
+// matches returns for every line of a the index of the same line in b, or -1
+// if it was removed.
+func matches(a, b []string) []int {
+	m := make([]int, len(a))
+	i, j := 0, 0
+	for _, edit := range diffStrings(a, b) {
+		switch edit.op {
+		case diffEqual:
+			m[i] = j
+			i++
+			j++
+		case diffDelete:
+			m[i] = -1
+			i++
+		case diffInsert:
+			j++
+		}
+	}
+	return m
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// merge3 combines the changes made to base in ours and theirs. Parts changed
+// differently in both are included with conflict markers. It returns the merged
+// lines and the number of conflicts.
+func merge3(base, ours, theirs []string) (merged []string, conflicts int) {
+	mo, mt := matches(base, ours), matches(base, theirs)
+	i, o, t := 0, 0, 0
+	for i < len(base) || o < len(ours) || t < len(theirs) {
+		// Lines unchanged in both versions
+		if i < len(base) && mo[i] == o && mt[i] == t {
+			merged = append(merged, base[i])
+			i, o, t = i+1, o+1, t+1
+			continue
+		}
+		// The changed chunk ends at the next line which is kept in both versions.
+		end := i
+		for end < len(base) && (mo[end] == -1 || mt[end] == -1) {
+			end++
+		}
+		oEnd, tEnd := len(ours), len(theirs)
+		if end < len(base) {
+			oEnd, tEnd = mo[end], mt[end]
+		}
+		b, oc, tc := base[i:end], ours[o:oEnd], theirs[t:tEnd]
+		switch {
+		case equalLines(oc, b) || equalLines(oc, tc):
+			merged = append(merged, tc...)
+		case equalLines(tc, b):
+			merged = append(merged, oc...)
+		default:
+			conflicts++
+			merged = append(merged, conflictOurs)
+			merged = append(merged, oc...)
+			merged = append(merged, conflictMiddle)
+			merged = append(merged, tc...)
+			merged = append(merged, conflictTheirs)
+		}
+		i, o, t = end, oEnd, tEnd
+	}
+	return
+}
+
+// headerConflict is a part of the header block changed differently in both versions.
+type headerConflict struct {
+	Name   string
+	Yours  string
+	Theirs string
+}
+
+// mergeValue returns the value changed in one of the versions. If both changed it
+// differently, ours is kept and ok is false. Missing headers have empty values.
+func mergeValue(base, ours, theirs string) (merged string, ok bool) {
+	switch {
+	case ours == base || ours == theirs:
+		return theirs, true
+	case theirs == base:
+		return ours, true
+	}
+	return ours, false
+}
+
+// mergeHeaders combines the changes made to the headers of base in ours and theirs.
+func mergeHeaders(base, ours, theirs map[string]string) (merged map[string]string, conflicts []headerConflict) {
+	var names []string
+	for _, headers := range []map[string]string{base, ours, theirs} {
+		for name := range headers {
+			if !contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	merged = make(map[string]string, len(names))
+	for _, name := range names {
+		value, ok := mergeValue(base[name], ours[name], theirs[name])
+		if !ok {
+			conflicts = append(conflicts, headerConflict{name, ours[name], theirs[name]})
+		}
+		if value != "" {
+			merged[name] = value
+		}
+	}
+	return
+}
+
+// splitLines splits text into lines, ignoring the differences between line endings.
+func splitLines(text string) []string {
+	return strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+}
+
+// serveConflict shows the editor with the changes from the form merged into the
+// current version of the document, which was changed since the form was loaded.
+func serveConflict(w http.ResponseWriter, data documentForm) {
+	currentFile, _ := docIndex.file(data.Id)
+	current := parseFile(currentFile)
+
+	// If the version from which the editing started is unknown,
+	// everything changed in both versions is a conflict.
+	var base document
+	generation, ok := baseGeneration(data.Id, data.Base)
+	if ok {
+		if body, ok := readRevision(data.Id, generation); ok {
+			base = parseFile(docFile{data.Id, body})
+		}
+	}
+	merged, conflicts := merge3(splitLines(base.content), splitLines(data.Body), splitLines(current.content))
+	data.Body = strings.Join(merged, "\n")
+	data.Base = currentToken(data.Id)
+
+	// The title, host, slug and headers are merged too. Where both changed
+	// them differently, the values from the form are kept and listed.
+	ours := make(map[string]string)
+	if data.Headers != "" {
+		if err := json.Unmarshal([]byte(data.Headers), &ours); err != nil {
+			panic(appError{Err: err, Description: "Failed to parse document headers"})
+		}
+	}
+	headers, headerConflicts := mergeHeaders(base.headers, ours, current.headers)
+	headersJSON, err := json.Marshal(headers)
+	if err != nil {
+		panic(err)
+	}
+	data.Headers = string(headersJSON)
+	for _, field := range []struct {
+		name         string
+		value        *string
+		base, theirs string
+	}{
+		{"title", &data.Title, base.title, current.title},
+		{"host", &data.Host, base.host, current.host},
+		{"slug", &data.Slug, base.slug, current.slug},
+	} {
+		ours := *field.value
+		if *field.value, ok = mergeValue(field.base, ours, field.theirs); !ok {
+			headerConflicts = append(headerConflicts, headerConflict{field.name, ours, field.theirs})
+		}
+	}
+
+	var pageBuilder strings.Builder
+	err = templates.ExecuteTemplate(&pageBuilder, "conflict.html", struct {
+		documentForm
+		Conflicts       int
+		HeaderConflicts []headerConflict
+		Author          string
+		Generation      uint64 // The version from which the editing started, 0 if unknown
+	}{data, conflicts, headerConflicts, revisionInfos(data.Id, []string{"current"})[0].Author, generation})
+	if err != nil {
+		panic(appError{Err: err, Description: "Failed to generate conflict page"})
+	}
+	w.WriteHeader(http.StatusConflict)
+	w.Write([]byte(createPage("Manesei (conflict)", template.HTML(pageBuilder.String()))))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMerge3(t *testing.T) {
+	for _, test := range []struct {
+		base, ours, theirs, merged string
+		conflicts                  int
+	}{
+		{"a\nb\nc", "a\nb\nc", "a\nB\nc", "a\nB\nc", 0},
+		{"a\nb\nc", "A\nb\nc", "a\nb\nC", "A\nb\nC", 0},
+		{"a\nb\nc", "a\nx\nc", "a\nx\nc", "a\nx\nc", 0},
+		{"a\nb\nc", "a\nc", "a\nb\nc\nd", "a\nc\nd", 0},
+		{"a\nb\nc", "a\nx\nc", "a\ny\nc", "a\n" + conflictOurs + "\nx\n" + conflictMiddle + "\ny\n" + conflictTheirs + "\nc", 1},
+	} {
+		merged, conflicts := merge3(splitLines(test.base), splitLines(test.ours), splitLines(test.theirs))
+		if strings.Join(merged, "\n") != test.merged || conflicts != test.conflicts {
+			t.Errorf("merge3(%q, %q, %q) = %q, %d", test.base, test.ours, test.theirs, strings.Join(merged, "\n"), conflicts)
+		}
+	}
+}
+
+func TestMergeHeaders(t *testing.T) {
+	base := map[string]string{"kept": "1", "ours": "1", "theirs": "1", "both": "1", "removed": "1"}
+	ours := map[string]string{"kept": "1", "ours": "2", "theirs": "1", "both": "2", "added": "1"}
+	theirs := map[string]string{"kept": "1", "ours": "1", "theirs": "2", "both": "3", "removed": "1"}
+	merged, conflicts := mergeHeaders(base, ours, theirs)
+	expected := map[string]string{"kept": "1", "ours": "2", "theirs": "2", "both": "2", "added": "1"}
+	if !reflect.DeepEqual(merged, expected) {
+		t.Errorf("merged %v, expected %v", merged, expected)
+	}
+	if !reflect.DeepEqual(conflicts, []headerConflict{{"both", "2", "3"}}) {
+		t.Errorf("conflicts %v", conflicts)
+	}
+}
+
+func postEditor(t *testing.T, base, body string) int {
+	t.Helper()
+	form := url.Values{"Id": {"a"}, "Host": {""}, "Slug": {"a"}, "Title": {"A"}, "Body": {body}, "Base": {base}}
+	r := httptest.NewRequest(http.MethodPost, "/edit/a", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	errorHandler(serveEditor()).ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestEditorConflictAfterUnchangedSave(t *testing.T) {
+	useTemporaryStore(t)
+	writeRevision(docFile{"a", ":a A\n\nzero"}, "", "")
+	for _, content := range []string{"one", "two", "two"} {
+		if code := postEditor(t, currentToken("a"), content); code != http.StatusSeeOther {
+			t.Fatalf("saving %q: %d", content, code)
+		}
+	}
+	base := currentToken("a") // Both start editing the same version.
+	if code := postEditor(t, base, "three"); code != http.StatusSeeOther {
+		t.Fatalf("first save: %d", code)
+	}
+	if code := postEditor(t, base, "four"); code != http.StatusConflict {
+		t.Fatalf("second save: %d, expected a conflict", code)
+	}
+	if f, _ := docIndex.file("a"); !strings.HasSuffix(f.Body, "three") {
+		t.Errorf("the first save was overwritten: %q", f.Body)
+	}
+	if generation, ok := baseGeneration("a", base); !ok {
+		t.Error("the base version wasn't found")
+	} else if body, _ := readRevision("a", generation); !strings.HasSuffix(body, "two") {
+		t.Errorf("base version %q", body)
+	}
+}
+
+func TestAPIConflict(t *testing.T) {
+	useTemporaryStore(t)
+	writeRevision(docFile{"a", ":a A\n\none"}, "", "")
+	put := func(etag, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, "/documents/a", strings.NewReader(`{"body": "`+body+`"}`))
+		if etag != "" {
+			r.Header.Set("If-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		apiErrorHandler(serveAPI()).ServeHTTP(w, r)
+		return w
+	}
+	etag := documentETag("a")
+	w := put(etag, `:a A\n\ntwo`)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Fatalf("first save: %d %q", w.Code, w.Header().Get("ETag"))
+	}
+	if w := put(etag, `:a A\n\nthree`); w.Code != http.StatusConflict {
+		t.Fatalf("stale save: %d", w.Code)
+	}
+	if w := put("", `:a A\n\nfour`); w.Code != http.StatusOK {
+		t.Fatalf("unconditional save: %d", w.Code)
+	}
+}
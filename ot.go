@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"unicode/utf16"
+)
+
+// Text is edited collaboratively using operational transformation. An operation
+// is a list of components which retain, insert or delete characters, walking
+// over the whole text. The text is indexed in UTF-16 code units, like in
+// JavaScript. In JSON an operation is an array in which positive numbers
+// retain, negative numbers delete and strings are inserted.
+
+var errOperation = errors.New("invalid operation")
+
+// maxOperationLength limits the numbers of characters retained or deleted by a
+// component of a decoded operation. Longer texts aren't edited together.
+const maxOperationLength = 1 << 24
+
+type otComponent struct {
+	retain int
+	delete int
+	insert []uint16
+}
+
+type textOperation []otComponent
+
+func (op *textOperation) retain(n int) {
+	if n <= 0 {
+		return
+	}
+	if l := len(*op); l != 0 && (*op)[l-1].retain != 0 {
+		(*op)[l-1].retain += n
+		return
+	}
+	*op = append(*op, otComponent{retain: n})
+}
+
+func (op *textOperation) delete(n int) {
+	if n <= 0 {
+		return
+	}
+	if l := len(*op); l != 0 && (*op)[l-1].delete != 0 {
+		(*op)[l-1].delete += n
+		return
+	}
+	*op = append(*op, otComponent{delete: n})
+}
+
+// insert adds an insertion. Insertions are kept before deletions
+// at the same position, so that equal operations look the same.
+func (op *textOperation) insert(s []uint16) {
+	if len(s) == 0 {
+		return
+	}
+	l := len(*op)
+	if l != 0 && (*op)[l-1].insert != nil {
+		(*op)[l-1].insert = append((*op)[l-1].insert, s...)
+		return
+	}
+	if l != 0 && (*op)[l-1].delete != 0 {
+		if l > 1 && (*op)[l-2].insert != nil {
+			(*op)[l-2].insert = append((*op)[l-2].insert, s...)
+			return
+		}
+		*op = append(*op, (*op)[l-1])
+		(*op)[l-1] = otComponent{insert: append([]uint16(nil), s...)}
+		return
+	}
+	*op = append(*op, otComponent{insert: append([]uint16(nil), s...)})
+}
+
+// baseLength returns the length of the text to which the operation
+// applies, or -1 if the components are invalid or their sum overflows.
+func (op textOperation) baseLength() (n int) {
+	for _, c := range op {
+		l := c.retain + c.delete
+		if c.retain < 0 || c.delete < 0 || l < 0 || n > math.MaxInt-l {
+			return -1
+		}
+		n += l
+	}
+	return
+}
+
+// apply returns the text changed by the operation.
+func (op textOperation) apply(text []uint16) ([]uint16, error) {
+	if op.baseLength() != len(text) {
+		return nil, errOperation
+	}
+	result := make([]uint16, 0, len(text))
+	i := 0
+	for _, c := range op {
+		if c.retain > len(text)-i || c.delete > len(text)-i {
+			return nil, errOperation
+		}
+		switch {
+		case c.retain != 0:
+			result = append(result, text[i:i+c.retain]...)
+			i += c.retain
+		case c.delete != 0:
+			i += c.delete
+		default:
+			result = append(result, c.insert...)
+		}
+	}
+	return result, nil
+}
+
+// transform returns the operations a' and b' such that applying b' after a
+// gives the same result as applying a' after b. Both a and b apply to the same
+// text. When both insert at the same position, the insertion of a goes first.
+func transform(a, b textOperation) (aPrime, bPrime textOperation, err error) {
+	if a.baseLength() < 0 || a.baseLength() != b.baseLength() {
+		return nil, nil, errOperation
+	}
+	i, j := 0, 0
+	var ca, cb *otComponent
+	next := func(op textOperation, k *int) *otComponent {
+		if *k == len(op) {
+			return nil
+		}
+		c := op[*k]
+		*k++
+		return &c
+	}
+	ca, cb = next(a, &i), next(b, &j)
+	for ca != nil || cb != nil {
+		if ca != nil && ca.insert != nil {
+			aPrime.insert(ca.insert)
+			bPrime.retain(len(ca.insert))
+			ca = next(a, &i)
+			continue
+		}
+		if cb != nil && cb.insert != nil {
+			aPrime.retain(len(cb.insert))
+			bPrime.insert(cb.insert)
+			cb = next(b, &j)
+			continue
+		}
+		if ca == nil || cb == nil {
+			return nil, nil, errOperation
+		}
+		la, lb := ca.retain+ca.delete, cb.retain+cb.delete
+		n := la
+		if lb < n {
+			n = lb
+		}
+		switch {
+		case ca.retain != 0 && cb.retain != 0:
+			aPrime.retain(n)
+			bPrime.retain(n)
+		case ca.delete != 0 && cb.retain != 0:
+			aPrime.delete(n)
+		case ca.retain != 0 && cb.delete != 0:
+			bPrime.delete(n)
+		}
+		// Both deleting the same characters needs no operation.
+		if la == n {
+			ca = next(a, &i)
+		} else if ca.retain != 0 {
+			ca.retain -= n
+		} else {
+			ca.delete -= n
+		}
+		if lb == n {
+			cb = next(b, &j)
+		} else if cb.retain != 0 {
+			cb.retain -= n
+		} else {
+			cb.delete -= n
+		}
+	}
+	return
+}
+
+// replaceOperation returns an operation changing the text from old to new,
+// replacing the part between their common prefix and suffix.
+func replaceOperation(old, new []uint16) (op textOperation) {
+	prefix := 0
+	for prefix < len(old) && prefix < len(new) && old[prefix] == new[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(old)-prefix && suffix < len(new)-prefix && old[len(old)-1-suffix] == new[len(new)-1-suffix] {
+		suffix++
+	}
+	// Surrogate pairs are not split.
+	if prefix > 0 && utf16.IsSurrogate(rune(old[prefix-1])) && old[prefix-1] < 0xdc00 {
+		prefix--
+	}
+	if suffix > 0 && utf16.IsSurrogate(rune(old[len(old)-suffix])) && old[len(old)-suffix] >= 0xdc00 {
+		suffix--
+	}
+	op.retain(prefix)
+	op.delete(len(old) - prefix - suffix)
+	op.insert(new[prefix : len(new)-suffix])
+	op.retain(suffix)
+	return
+}
+
+func (op textOperation) MarshalJSON() ([]byte, error) {
+	components := make([]interface{}, len(op))
+	for i, c := range op {
+		switch {
+		case c.retain != 0:
+			components[i] = c.retain
+		case c.delete != 0:
+			components[i] = -c.delete
+		default:
+			components[i] = string(utf16.Decode(c.insert))
+		}
+	}
+	return json.Marshal(components)
+}
+
+func (op *textOperation) UnmarshalJSON(data []byte) error {
+	var components []interface{}
+	if err := json.Unmarshal(data, &components); err != nil {
+		return err
+	}
+	*op = nil
+	for _, c := range components {
+		switch c := c.(type) {
+		case float64:
+			if c > maxOperationLength || c < -maxOperationLength || c != float64(int(c)) || c == 0 {
+				return errOperation
+			} else if c > 0 {
+				op.retain(int(c))
+			} else {
+				op.delete(int(-c))
+			}
+		case string:
+			if c == "" {
+				return errOperation
+			}
+			op.insert(utf16.Encode([]rune(c)))
+		default:
+			return errOperation
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"testing"
+	"unicode/utf16"
+)
+
+func randomOperation(r *rand.Rand, text []uint16) (op textOperation) {
+	for i := 0; i < len(text); {
+		n := 1 + r.Intn(len(text)-i)
+		switch r.Intn(3) {
+		case 0:
+			op.retain(n)
+		case 1:
+			op.delete(n)
+		default:
+			op.insert(utf16.Encode([]rune("xy")[:1+r.Intn(2)]))
+			continue
+		}
+		i += n
+	}
+	if r.Intn(2) == 0 {
+		op.insert(utf16.Encode([]rune("z")))
+	}
+	return
+}
+
+func TestTransformConverges(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		text := utf16.Encode([]rune("abcdefghij"[:r.Intn(11)]))
+		a, b := randomOperation(r, text), randomOperation(r, text)
+		aPrime, bPrime, err := transform(a, b)
+		if err != nil {
+			t.Fatalf("transform(%v, %v): %v", a, b, err)
+		}
+		afterA, err := a.apply(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		afterB, err := b.apply(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ab, err := bPrime.apply(afterA)
+		if err != nil {
+			t.Fatalf("b' after a: %v", err)
+		}
+		ba, err := aPrime.apply(afterB)
+		if err != nil {
+			t.Fatalf("a' after b: %v", err)
+		}
+		if string(utf16.Decode(ab)) != string(utf16.Decode(ba)) {
+			t.Fatalf("%q: a=%v b=%v diverged: %q != %q", string(utf16.Decode(text)), a, b, string(utf16.Decode(ab)), string(utf16.Decode(ba)))
+		}
+	}
+}
+
+func TestReplaceOperation(t *testing.T) {
+	for _, test := range []struct{ old, new string }{
+		{"", ""}, {"", "abc"}, {"abc", ""}, {"abc", "abc"}, {"abcdef", "abXYef"}, {"aaa", "aa"}, {"ä😀b", "ä😁b"},
+	} {
+		old, new := utf16.Encode([]rune(test.old)), utf16.Encode([]rune(test.new))
+		result, err := replaceOperation(old, new).apply(old)
+		if err != nil || string(utf16.Decode(result)) != test.new {
+			t.Errorf("replaceOperation(%q, %q) gives %q, %v", test.old, test.new, string(utf16.Decode(result)), err)
+		}
+	}
+}
+
+func TestOperationJSON(t *testing.T) {
+	var op textOperation
+	if err := json.Unmarshal([]byte(`[2, "xy", -1, 3]`), &op); err != nil {
+		t.Fatal(err)
+	}
+	result, err := op.apply(utf16.Encode([]rune("abcdef")))
+	if err != nil || string(utf16.Decode(result)) != "abxydef" {
+		t.Errorf("got %q, %v", string(utf16.Decode(result)), err)
+	}
+	data, err := json.Marshal(op)
+	if err != nil || string(data) != `[2,"xy",-1,3]` {
+		t.Errorf("got %s, %v", data, err)
+	}
+}
+
+func TestInvalidOperationJSON(t *testing.T) {
+	for _, input := range []string{
+		`[4611686018427387904, 4611686018427387904]`,
+		`[-4611686018427387904]`,
+		`[1e300]`,
+		`[1.5]`,
+		`[0]`,
+		`[""]`,
+		`[null]`,
+		`[[1]]`,
+		`{}`,
+	} {
+		var op textOperation
+		if err := json.Unmarshal([]byte(input), &op); err == nil {
+			t.Errorf("%s was accepted as %v", input, op)
+		}
+	}
+}
+
+func TestInvalidOperations(t *testing.T) {
+	text := utf16.Encode([]rune("abc"))
+	for _, op := range []textOperation{
+		{{retain: math.MaxInt}, {retain: math.MaxInt}, {retain: 5}},
+		{{retain: math.MaxInt - 1}, {delete: 4}},
+		{{retain: -1}, {retain: 4}},
+		{{retain: 4}, {delete: -1}},
+		{{retain: 2}},
+		{{retain: 4}},
+	} {
+		func() {
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					t.Errorf("apply(%v) panicked: %v", op, recovered)
+				}
+			}()
+			if _, err := op.apply(text); err != errOperation {
+				t.Errorf("apply(%v) = %v, expected errOperation", op, err)
+			}
+			var other textOperation
+			other.retain(3)
+			if _, _, err := transform(op, other); err != errOperation {
+				t.Errorf("transform(%v) = %v, expected errOperation", op, err)
+			}
+		}()
+	}
+}
@@ -6,8 +6,26 @@ import (
 	"math"
 	"strconv"
 	"strings"
+	"unicode"
 )
 
+// inlineDelimiters are the delimiters of inline formatting. Longer
+// delimiters come first, so that they are matched before their prefixes.
+var inlineDelimiters = []string{"**", "*", "~~", "~", "==", "^"}
+
+// inlineTags maps delimiters of inline formatting to HTML elements.
+var inlineTags = map[string]string{
+	"**": "strong",
+	"*":  "em",
+	"~~": "s",
+	"~":  "sub",
+	"==": "mark",
+	"^":  "sup",
+}
+
+// escapable contains characters which are written literally when preceded by a backslash.
+const escapable = "\\`{}*~=^"
+
 type stack[T any] struct {
 	l *list.List
 }
@@ -37,23 +55,195 @@ func (s *stack[T]) pop() T {
 	return s.l.Remove(tail).(T)
 }
 
-func parseDocument(document string) (html template.HTML) {
+// escapeRune returns the HTML representation of a character of the text.
+// Control characters other than whitespace are omitted.
+func escapeRune(r rune) string {
+	switch r {
+	case '<':
+		return "&lt;"
+	case '>':
+		return "&gt;"
+	case '&':
+		return "&amp;"
+	case '"':
+		return "&#34;"
+	case '\'':
+		return "&#39;"
+	case '\n', '\r', '\t':
+		return string(r)
+	}
+	if unicode.IsControl(r) {
+		return ""
+	}
+	return string(r)
+}
+
+// safeLinkTarget checks if the target of a link can be used as a URL. Relative
+// URLs and URLs with a few known schemes are allowed, so that, for example,
+// `javascript:` URLs can't be used.
+func safeLinkTarget(target string) bool {
+	// Browsers ignore whitespace and control characters in URLs.
+	normalized := strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, target)
+	i := strings.IndexAny(normalized, ":/?#")
+	if i == -1 || normalized[i] != ':' {
+		return true // Relative URL
+	}
+	switch normalized[:i] {
+	case "http", "https", "mailto", "ftp":
+		return true
+	}
+	return false
+}
+
+func parseDocument(document string) template.HTML {
+	return parseDocumentWith(document, nil)
+}
+
+// queryRenderer returns the HTML showing the result of a query block, which
+// is a code block starting with "```query". See query.go.
+type queryRenderer func(query string) template.HTML
+
+// parseDocumentWith works like parseDocument, but renders query blocks with
+// the given function. If it is nil, they are shown like other code blocks.
+func parseDocumentWith(document string, renderQuery queryRenderer) (html template.HTML) {
 	content := []rune("\n" + document) // The newline simplifies finding tokens which are at the start of a line.
 	length := len(content)
 	var i int // Current index
 	var out string
 
 	element := newStack[string]()
-	linkStart := 0     // Stores the index of the start of the text between a link's braces.
-	headingLevel := "" // Stores the last added heading, e.g. `h1`.
-	// TODO (nested): listLevel := newStack[int]()
+	headingLevel := ""           // Stores the last added heading, e.g. `h1`.
+	listLevel := newStack[int]() // Stores the indentation of each open list.
+	codeIndent := 0              // Stores the indentation of the beginning of the current code block.
+	lineIndent := 0              // Stores the indentation removed from the current line.
+
+	// matchAt checks if there is an occurrence of substr at the index j of input.
+	matchAt := func(j int, substr string) bool {
+		if j+len(substr) > length {
+			return false
+		}
+		return string(content[j:j+len(substr)]) == (substr)
+	}
 
 	// match checks if there is an occurrence of substr at the current index of input.
 	match := func(substr string) bool {
-		if i+len(substr) > length {
+		return matchAt(i, substr)
+	}
+
+	// indentation counts the spaces and tabs after the newline at the current index.
+	indentation := func() int {
+		n := 0
+		for i+1+n < length && (content[i+1+n] == ' ' || content[i+1+n] == '\t') {
+			n++
+		}
+		return n
+	}
+
+	// unindent skips n characters of indentation after the newline at the current
+	// index, so that the following line is handled as if it weren't indented.
+	unindent := func(n int) {
+		if n > 0 {
+			i += n
+			content[i] = '\n'
+		}
+		lineIndent = n
+	}
+
+	// inlineOpen checks if the inline element is open and can be closed, that is
+	// if there are only inline formatting elements above it in the stack.
+	inlineOpen := func(name string) bool {
+		for e := element.l.Back(); e != nil; e = e.Prev() {
+			if e.Value.(string) == name {
+				return true
+			}
+			if inlineTags[e.Value.(string)] == "" {
+				return false
+			}
+		}
+		return false
+	}
+
+	// closeInline closes inline elements down to and including name.
+	closeInline := func(name string) {
+		for element.l.Len() != 0 {
+			e := element.pop()
+			if e == "{}" {
+				out += "</a>"
+			} else {
+				out += "</" + inlineTags[e] + ">"
+			}
+			if e == name {
+				return
+			}
+		}
+	}
+
+	// canOpen checks if the inline formatting starting at the current index
+	// is closed later in the same line. The content of the element can't
+	// start or end with whitespace, and it can't consist only of the
+	// characters of the delimiter, like in `^^^`.
+	canOpen := func(delimiter string) bool {
+		start := i + len(delimiter)
+		if start >= length || unicode.IsSpace(content[start]) {
 			return false
 		}
-		return string(content[i:i+len(substr)]) == (substr)
+		empty := true
+		for j := start; j < length && content[j] != '\n'; j++ {
+			if !empty && matchAt(j, delimiter) && !unicode.IsSpace(content[j-1]) {
+				return true
+			}
+			empty = empty && content[j] == rune(delimiter[0])
+		}
+		return false
+	}
+
+	// closingRun returns the number of the innermost inline elements closed by the
+	// run of delimiter characters at the current index, if it consists exactly of
+	// their delimiters, like `***` closing `*` inside `**`. Otherwise it returns 0.
+	closingRun := func() int {
+		run := 0
+		for i+run < length && content[i+run] == content[i] {
+			run++
+		}
+		n := 0
+		for e := element.l.Back(); e != nil && run > 0; e = e.Prev() {
+			delimiter := e.Value.(string)
+			if inlineTags[delimiter] == "" || rune(delimiter[0]) != content[i] || len(delimiter) > run {
+				break
+			}
+			run -= len(delimiter)
+			n++
+		}
+		if run != 0 {
+			return 0
+		}
+		return n
+	}
+
+	// matchDelimiter returns the delimiter of inline formatting at the current index.
+	matchDelimiter := func() string {
+		for _, delimiter := range inlineDelimiters {
+			if match(delimiter) {
+				return delimiter
+			}
+		}
+		return ""
+	}
+
+	openList := func(kind string, indent int) {
+		element.push(kind)
+		listLevel.push(indent)
+		out += "<" + kind + "><li>"
+	}
+
+	closeList := func() {
+		listLevel.pop()
+		out += "</li></" + element.pop() + ">"
 	}
 
 	// countConsecutive counts consecutive occurrences of substr at the current index of input.
@@ -69,6 +259,27 @@ func parseDocument(document string) (html template.HTML) {
 
 	for i = 0; i < length; i++ {
 		if match("\n") {
+			lineIndent = 0
+			// Inline formatting doesn't continue to the next line.
+			for tag := inlineTags[element.peek()]; tag != ""; tag = inlineTags[element.peek()] {
+				element.pop()
+				out += "</" + tag + ">"
+			}
+			if listLevel.l.Len() != 0 {
+				// Block quotes and code blocks inside list items are indented.
+				switch element.peek() {
+				case "blockquote":
+					if n := indentation(); n > listLevel.peek() && matchAt(i+1+n, "> ") {
+						unindent(n)
+					}
+				case "```":
+					n := indentation()
+					if n > codeIndent {
+						n = codeIndent
+					}
+					unindent(n)
+				}
+			}
 			switch element.peek() {
 			case "h": // End of a heading
 				element.pop()
@@ -82,30 +293,59 @@ func parseDocument(document string) (html template.HTML) {
 					i += 2
 					continue
 				}
-			case "ul":
-				if !match("\n- ") { // End of the list
-					element.pop()
-					out += "</li></ul>"
-				} else { // New bullet point
-					out += "</li><li>"
-					i += 2
-					continue
-				}
-			case "ol":
-				if !match("\n. ") { // End of the list
-					element.pop()
-					out += "</li></ol>"
-				} else { // New list element
-					out += "</li><li>"
-					i += 2
-					continue
-				}
+			case "ul", "ol": // Handled below
 			default: // New line
 				out += "\n"
 			}
+			if top := element.peek(); top == "ul" || top == "ol" {
+				n := indentation()
+				start := i + 1 + n                                // Start of the line's content
+				if matchAt(start, "- ") || matchAt(start, ". ") { // New list element
+					kind := "ul"
+					if matchAt(start, ". ") {
+						kind = "ol"
+					}
+					for listLevel.l.Len() != 0 && n < listLevel.peek() {
+						closeList()
+					}
+					if listLevel.l.Len() != 0 && n == listLevel.peek() && element.peek() == kind {
+						out += "</li><li>"
+					} else {
+						if listLevel.l.Len() != 0 && n == listLevel.peek() {
+							// A list of the other kind at the same level
+							closeList()
+						}
+						openList(kind, n)
+					}
+					i += n + 2
+					continue
+				} else if n > listLevel.peek() && start < length && content[start] != '\n' {
+					// Continuation of the list element, which may contain block elements.
+					unindent(n)
+					out += "\n"
+				} else { // End of the list
+					for listLevel.l.Len() != 0 {
+						closeList()
+					}
+				}
+			}
 		}
-		if element.peek() == "{}" && !match("}") {
-			// The current element is a link, and the current character doesn't close it.
+		if match("\n") && element.peek() == "{}" {
+			// Links can span multiple lines, but block elements can't start inside them.
+			continue
+		}
+		if renderQuery != nil && element.peek() != "```" && match("\n```query") &&
+			(i+9 == length || unicode.IsSpace(content[i+9])) { // Query block
+			start := i + 9
+			for start < length && content[start] != '\n' {
+				start++
+			}
+			end := start
+			for end < length && !matchAt(end, "\n```") {
+				end++
+			}
+			out += string(renderQuery(string(content[start:end]))) + "\b"
+			i = end + 3
 			continue
 		}
 		if match("\n```") { // Code block
@@ -114,7 +354,8 @@ func parseDocument(document string) (html template.HTML) {
 				out += "</pre>\b" // Refer to the comment at the last loop in this function.
 			} else { // Beginning
 				element.push("```")
-				if out[len(out)-3:len(out)-1] == "\b\n" {
+				codeIndent = lineIndent
+				if len(out) >= 3 && out[len(out)-3:len(out)-1] == "\b\n" {
 					// Deletes the excess newline between two consecutive
 					// code blocks without an empty line between them.
 					out = out[:len(out)-2]
@@ -126,10 +367,16 @@ func parseDocument(document string) (html template.HTML) {
 		}
 		if element.peek() == "```" { // Code block content
 			if !match("\n") {
-				out += string(content[i])
+				out += escapeRune(content[i])
 			}
 			continue
 		}
+		if element.peek() != "`" && match("\\") && i+1 < length && strings.ContainsRune(escapable, content[i+1]) {
+			// Escaped character
+			i++
+			out += escapeRune(content[i])
+			continue
+		}
 		if match("`") { // Inline code
 			if element.peek() == "`" { // End
 				element.pop()
@@ -142,28 +389,71 @@ func parseDocument(document string) (html template.HTML) {
 		}
 		if element.peek() == "`" { // Inline code content
 			if !match("\n") {
-				out += string(content[i])
+				out += escapeRune(content[i])
 			}
 			continue
 		}
-		if match("{") { // Beginning of a link
-			element.push("{}")
-			linkStart = i + 1
+		if match("{") && !inlineOpen("{}") { // Beginning of a link
+			end := i + 1
+			for end < length && content[end] != '}' {
+				end++
+			}
+			if end < length {
+				// The target is followed by the text of the link.
+				textStart := end
+				for j := i + 1; j < end; j++ {
+					if content[j] == ' ' {
+						textStart = j
+						break
+					}
+				}
+				target := string(content[i+1 : textStart])
+				if safeLinkTarget(target) {
+					out += `<a href="` + template.HTMLEscapeString(target) + `">`
+				} else {
+					out += "<a>"
+				}
+				if textStart == end { // The target is also used as the text.
+					out += template.HTMLEscapeString(target) + "</a>"
+					i = end
+				} else {
+					element.push("{}")
+					i = textStart
+				}
+				continue
+			}
+		}
+		if match("}") && inlineOpen("{}") { // End of a link
+			closeInline("{}")
 			continue
 		}
-		if match("}") { // End of a link
-			element.pop()
-			link := content[linkStart:i]
-			sliced := strings.SplitN(string(link), " ", 2)
-			sliced = append(sliced, sliced[0])
-			out += `<a href="` + sliced[0] + `">` + sliced[1] + "</a>"
+		if n := closingRun(); n != 0 && !unicode.IsSpace(content[i-1]) {
+			// End of nested inline formatting, the innermost element is closed first.
+			for ; n != 0; n-- {
+				delimiter := element.peek()
+				closeInline(delimiter)
+				i += len(delimiter)
+			}
+			i--
 			continue
 		}
+		if delimiter := matchDelimiter(); delimiter != "" { // Inline formatting
+			if inlineOpen(delimiter) && !unicode.IsSpace(content[i-1]) { // End
+				closeInline(delimiter)
+				i += len(delimiter) - 1
+				continue
+			} else if canOpen(delimiter) { // Beginning
+				element.push(delimiter)
+				out += "<" + inlineTags[delimiter] + ">"
+				i += len(delimiter) - 1
+				continue
+			}
+		}
 		if match("\n#") { // Heading
 			i++
 			num := countConsecutive("#")
 			i--
-			if content[i+1+num] == ' ' {
+			if i+1+num < length && content[i+1+num] == ' ' {
 				headingLevel = "h" + strconv.Itoa(int(math.Min(float64(num), 6)))
 				element.push("h")
 				out += "<" + headingLevel + ">"
@@ -178,14 +468,12 @@ func parseDocument(document string) (html template.HTML) {
 			continue
 		}
 		if match("\n- ") { // Unordered list
-			element.push("ul")
-			out += "<ul><li>"
+			openList("ul", 0)
 			i += 2
 			continue
 		}
 		if match("\n. ") { // Ordered list
-			element.push("ol")
-			out += "<ol><li>"
+			openList("ol", 0)
 			i += 2
 			continue
 		}
@@ -195,12 +483,34 @@ func parseDocument(document string) (html template.HTML) {
 			continue
 		}
 		if !match("\n") { // Character copied literally
-			out += string(content[i])
+			out += escapeRune(content[i])
+		}
+	}
+
+	// Elements which are still open are closed, so that the output is well-formed.
+	for element.l.Len() != 0 {
+		switch top := element.peek(); top {
+		case "h":
+			element.pop()
+			out += "</" + headingLevel + ">"
+		case "blockquote":
+			element.pop()
+			out += "</blockquote>"
+		case "ul", "ol":
+			closeList()
+		case "```":
+			element.pop()
+			out += "</pre>"
+		case "`":
+			element.pop()
+			out += "</code>"
+		default: // Links and inline formatting
+			closeInline(top)
 		}
 	}
 
 	var outRunes []rune
-	if out[0] == '\n' {
+	if len(out) != 0 && out[0] == '\n' {
 		// Delete the newline added in the beginning of the function.
 		outRunes = []rune(out[1:])
 	} else {
@@ -223,3 +533,90 @@ func parseDocument(document string) (html template.HTML) {
 
 	return
 }
+
+// scanLinks calls fn with the start and end indices (of the runes of the
+// document) of the target of every `{}` link in the document. Like in
+// parseDocument, braces inside code blocks and inline code and escaped
+// braces don't start a link.
+func scanLinks(document string, fn func(start, end int)) {
+	content := []rune("\n" + document)
+	length := len(content)
+	var i int // Current index
+
+	match := func(substr string) bool {
+		if i+len(substr) > length {
+			return false
+		}
+		return string(content[i:i+len(substr)]) == (substr)
+	}
+
+	codeBlock := false
+	inlineCode := false
+	linkStart := -1 // Index of the start of the text between a link's braces, or -1 outside of links.
+	for i = 0; i < length; i++ {
+		if linkStart >= 0 {
+			if match("}") {
+				end := i
+				for j := linkStart; j < i; j++ {
+					if content[j] == ' ' {
+						end = j
+						break
+					}
+				}
+				// Indices are shifted by the newline added in the beginning.
+				fn(linkStart-1, end-1)
+				linkStart = -1
+			}
+			continue
+		}
+		if match("\n```") {
+			codeBlock = !codeBlock
+			i += 3
+			continue
+		}
+		if codeBlock {
+			continue
+		}
+		if !inlineCode && match("\\") && i+1 < length && strings.ContainsRune(escapable, content[i+1]) {
+			i++
+			continue
+		}
+		if match("`") {
+			inlineCode = !inlineCode
+			continue
+		}
+		if !inlineCode && match("{") {
+			linkStart = i + 1
+		}
+	}
+}
+
+// documentLinks returns the targets of all `{}` links in the document
+// in the order of their first occurrence.
+func documentLinks(document string) (links []string) {
+	content := []rune(document)
+	seen := make(map[string]bool)
+	scanLinks(document, func(start, end int) {
+		target := string(content[start:end])
+		if !seen[target] {
+			seen[target] = true
+			links = append(links, target)
+		}
+	})
+	return
+}
+
+// replaceLinks changes the target of all `{}` links pointing to from into to.
+func replaceLinks(document, from, to string) string {
+	content := []rune(document)
+	var out []rune
+	last := 0
+	scanLinks(document, func(start, end int) {
+		if string(content[start:end]) == from {
+			out = append(out, content[last:start]...)
+			out = append(out, []rune(to)...)
+			last = end
+		}
+	})
+	return string(append(out, content[last:]...))
+}
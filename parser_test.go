@@ -0,0 +1,149 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var (
+	tagPattern       = regexp.MustCompile(`<(/?)([a-z0-9]+)([^>]*)>`)
+	attributePattern = regexp.MustCompile(`\s([a-zA-Z-]+)(?:="([^"]*)")?`)
+)
+
+// checkHTML reports the problems of the output of parseDocument: elements
+// which aren't balanced, scripts, event handlers and unsafe links.
+func checkHTML(t *testing.T, input string, output string) {
+	t.Helper()
+	if strings.Contains(strings.ToLower(output), "<script") {
+		t.Errorf("%q: script in %q", input, output)
+	}
+	if strings.Count(output, "<") != len(tagPattern.FindAllString(output, -1)) {
+		t.Errorf("%q: unescaped < in %q", input, output)
+	}
+	var open []string
+	for _, tag := range tagPattern.FindAllStringSubmatch(output, -1) {
+		closing, name, attributes := tag[1] == "/", tag[2], tag[3]
+		for _, a := range attributePattern.FindAllStringSubmatch(attributes, -1) {
+			if strings.HasPrefix(strings.ToLower(a[1]), "on") {
+				t.Errorf("%q: event handler in %q", input, output)
+			}
+			if a[1] == "href" && !safeLinkTarget(html.UnescapeString(a[2])) {
+				t.Errorf("%q: unsafe link in %q", input, output)
+			}
+		}
+		switch {
+		case name == "hr":
+		case !closing:
+			open = append(open, name)
+		case len(open) == 0 || open[len(open)-1] != name:
+			t.Errorf("%q: unbalanced </%s> in %q", input, name, output)
+			return
+		default:
+			open = open[:len(open)-1]
+		}
+	}
+	if len(open) != 0 {
+		t.Errorf("%q: unclosed %v in %q", input, open, output)
+	}
+}
+
+func FuzzParseDocument(f *testing.F) {
+	for _, seed := range []string{
+		"<script>alert(1)</script>",
+		"# <script>alert(1)</script>",
+		"`<script>`",
+		"```\n<script>\n```",
+		"{javascript:alert(1) click}",
+		"{JavaScript:alert(1)}",
+		"{java\tscript:alert(1) click}",
+		"{ javascript:alert(1) click}",
+		"{\" onmouseover=\"alert(1) x}",
+		"<img src=x onerror=alert(1)>",
+		"&lt;script&gt; &amp; &#60; &",
+		"{&#106;avascript:alert(1) x}",
+		"**a *b***",
+		"*a **b***",
+		"***x***",
+		"**unbalanced *delimiters",
+		"~~a ~b~~ c~",
+		"{a **b} c**",
+		"**{a b**}",
+		"`a **b` c**",
+		"> a\n- b\n  > c\n  ```\n  d\n  ```\n. e",
+		"- a\n  - b\n    . c\n- d",
+		"\\*a* \\{b}",
+		"{a\n# b}",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, document string) {
+		checkHTML(t, document, string(parseDocument(document)))
+	})
+}
+
+func TestNestedLists(t *testing.T) {
+	for _, test := range []struct {
+		name, input, output string
+	}{
+		{"nested ul", "- a\n- b\n  - c\n  - d\n- e",
+			"<ul><li>a</li><li>b<ul><li>c</li><li>d</li></ul></li><li>e</li></ul>"},
+		{"nested ol", ". a\n. b\n  . c\n  . d\n. e",
+			"<ol><li>a</li><li>b<ol><li>c</li><li>d</li></ol></li><li>e</li></ol>"},
+		{"ol in ul", "- a\n  . b\n  . c\n- d",
+			"<ul><li>a<ol><li>b</li><li>c</li></ol></li><li>d</li></ul>"},
+		{"ul in ol", ". a\n  - b\n. c",
+			"<ol><li>a<ul><li>b</li></ul></li><li>c</li></ol>"},
+		{"other kind at the same level", "- a\n. b",
+			"<ul><li>a</li></ul><ol><li>b</li></ol>"},
+		{"dedent to the top", "- a\n  - b\n    - c\n      - d\n- e",
+			"<ul><li>a<ul><li>b<ul><li>c<ul><li>d</li></ul></li></ul></li></ul></li><li>e</li></ul>"},
+		{"dedent to the middle", "- a\n  - b\n    . c\n      - d\n  - e",
+			"<ul><li>a<ul><li>b<ol><li>c<ul><li>d</li></ul></li></ol></li><li>e</li></ul></li></ul>"},
+		{"dedent out of the list", "- a\n  - b\n    - c\nafter",
+			"<ul><li>a<ul><li>b<ul><li>c</li></ul></li></ul></li></ul>after"},
+		{"continuation", "- a\n  continued\n- b",
+			"<ul><li>a\ncontinued</li><li>b</li></ul>"},
+		{"block quote in item", "- a\n  > quote\n  > more\n- b",
+			"<ul><li>a\n<blockquote>quote\nmore</blockquote></li><li>b</li></ul>"},
+		{"block quote in nested item", "- a\n  - b\n    > quote\n- c",
+			"<ul><li>a<ul><li>b\n<blockquote>quote</blockquote></li></ul></li><li>c</li></ul>"},
+		{"code block in item", "- a\n  ```\n  code\n    indented\n  ```\n- b",
+			"<ul><li>a\n<pre>\ncode\n  indented\n</pre></li><li>b</li></ul>"},
+		{"code block in ordered item", ". a\n  ```\n  - not a list\n  ```\n. b",
+			"<ol><li>a\n<pre>\n- not a list\n</pre></li><li>b</li></ol>"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if output := string(parseDocument(test.input)); output != test.output {
+				t.Errorf("%q\ngot      %q\nexpected %q", test.input, output, test.output)
+			}
+		})
+	}
+}
+
+func TestNestedInlineFormatting(t *testing.T) {
+	for _, test := range []struct {
+		input, output string
+	}{
+		{"***x***", "<strong><em>x</em></strong>"},
+		{"**a *b***", "<strong>a <em>b</em></strong>"},
+		{"*a **b***", "<em>a <strong>b</strong></em>"},
+		{"**bold *both***", "<strong>bold <em>both</em></strong>"},
+		{"**a *b* c**", "<strong>a <em>b</em> c</strong>"},
+		{"~~a ~b~~~", "<s>a <sub>b</sub></s>"},
+		{"*a* **b**", "<em>a</em> <strong>b</strong>"},
+		{"*a***", "<em>a**</em>"},
+		{"^^^", "^^^"},
+		{"====", "===="},
+		{"=====", "====="},
+		{"~~~~~", "~~~~~"},
+		{"*****", "*****"},
+		{"a ^^^ b", "a ^^^ b"},
+		{"^a^ ==b==", "<sup>a</sup> <mark>b</mark>"},
+	} {
+		if output := string(parseDocument(test.input)); output != test.output {
+			t.Errorf("%q\ngot      %q\nexpected %q", test.input, output, test.output)
+		}
+	}
+}
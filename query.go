@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Query blocks embed tables of documents in the content of a document:
+//
+//	```query
+//	under: projects
+//	where: status = active
+//	where: due < 2024-01-01
+//	tag: work
+//	sort: -due
+//	limit: 10
+//	columns: title, status, owner
+//	```
+//
+// `under` selects the documents below a host, `where` compares a header with
+// a value using one of = != < <= > >=, and `tag` selects documents with the
+// tag. All conditions have to be met. Values are compared as numbers if both
+// are numbers, and as text otherwise. Besides the headers, title, slug, host
+// and tags can be used. Documents are sorted by title unless `sort` names
+// another header, descending if it starts with "-".
+
+const maxQueryResults = 500
+
+var queryOperators = []string{"<=", ">=", "!=", "=", "<", ">"} // Longer operators are matched first
+
+type queryCondition struct {
+	header   string
+	operator string
+	value    string
+}
+
+type documentQuery struct {
+	under      string
+	hasUnder   bool
+	conditions []queryCondition
+	tags       []string
+	sort       string
+	descending bool
+	limit      int
+	columns    []string
+}
+
+// parseQuery parses the text of a query block.
+func parseQuery(text string) (documentQuery, error) {
+	q := documentQuery{sort: "title", limit: maxQueryResults, columns: []string{"title"}}
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) == 1 {
+			return q, errors.New("expected `key: value`: " + strings.TrimSpace(line))
+		}
+		key, value := strings.ToLower(strings.TrimSpace(kv[0])), strings.TrimSpace(kv[1])
+		switch key {
+		case "under":
+			q.under, q.hasUnder = value, true
+		case "where":
+			condition, err := parseCondition(value)
+			if err != nil {
+				return q, err
+			}
+			q.conditions = append(q.conditions, condition)
+		case "tag", "tags":
+			q.tags = append(q.tags, parseTags(value)...)
+		case "sort":
+			q.sort = strings.TrimSpace(strings.TrimPrefix(value, "-"))
+			q.descending = strings.HasPrefix(value, "-")
+			if q.sort == "" {
+				return q, errors.New("sort needs a header")
+			}
+		case "limit":
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit <= 0 {
+				return q, errors.New("limit has to be a positive number: " + value)
+			}
+			if limit < maxQueryResults {
+				q.limit = limit
+			}
+		case "columns":
+			if q.columns = headerList(value); len(q.columns) == 0 {
+				return q, errors.New("columns can't be empty")
+			}
+		default:
+			return q, errors.New("unknown key: " + key)
+		}
+	}
+	return q, nil
+}
+
+func parseCondition(text string) (queryCondition, error) {
+	for _, operator := range queryOperators {
+		if i := strings.Index(text, operator); i != -1 {
+			c := queryCondition{strings.TrimSpace(text[:i]), operator, strings.TrimSpace(text[i+len(operator):])}
+			if c.header == "" {
+				break
+			}
+			return c, nil
+		}
+	}
+	return queryCondition{}, errors.New("expected `header operator value`: " + text)
+}
+
+// queryValue returns the value of a header of the document or of one of its fields.
+func queryValue(doc document, header string) string {
+	switch header {
+	case "title":
+		return doc.title
+	case "slug":
+		return doc.slug
+	case "host":
+		return doc.host
+	case "tags":
+		return strings.Join(doc.tags, ", ")
+	}
+	return doc.headers[header]
+}
+
+// compareValues compares two values as numbers if both are numbers, and as text otherwise.
+func compareValues(a, b string) int {
+	x, errX := strconv.ParseFloat(a, 64)
+	y, errY := strconv.ParseFloat(b, 64)
+	if errX == nil && errY == nil {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+func (c queryCondition) matches(doc document) bool {
+	value := queryValue(doc, c.header)
+	if c.header == "tags" {
+		// A document matches if any of its tags does.
+		for _, tag := range doc.tags {
+			if c.compare(tag) {
+				return true
+			}
+		}
+		return false
+	}
+	return c.compare(value)
+}
+
+func (c queryCondition) compare(value string) bool {
+	cmp := compareValues(value, c.value)
+	switch c.operator {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	}
+	return cmp >= 0
+}
+
+// subtree returns the slugs of the documents below the one with the given slug.
+func subtree(documents map[string]document, slug string) map[string]bool {
+	below := make(map[string]bool)
+	queue := append([]string(nil), documents[slug].children...)
+	for len(queue) != 0 {
+		child := queue[0]
+		queue = queue[1:]
+		if below[child] || child == slug {
+			continue // Cycle of hosts
+		}
+		below[child] = true
+		queue = append(queue, documents[child].children...)
+	}
+	return below
+}
+
+// run returns the documents matching the query which the visitor can read.
+func (q documentQuery) run(documents map[string]document, v visitor) []document {
+	var below map[string]bool
+	if q.hasUnder {
+		below = subtree(documents, q.under)
+	}
+	var results []document
+	for slug, doc := range documents {
+		if doc.id == "" || (below != nil && !below[slug]) || !v.canRead(documents, slug) {
+			continue
+		}
+		matching := true
+		for _, tag := range q.tags {
+			matching = matching && contains(doc.tags, tag)
+		}
+		for _, c := range q.conditions {
+			matching = matching && c.matches(doc)
+		}
+		if matching {
+			results = append(results, doc)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := queryValue(results[i], q.sort), queryValue(results[j], q.sort)
+		// Documents without the header come last.
+		if (a == "") != (b == "") {
+			return b == ""
+		}
+		if cmp := compareValues(a, b); cmp != 0 {
+			return (cmp < 0) != q.descending
+		}
+		return results[i].slug < results[j].slug
+	})
+	if len(results) > q.limit {
+		results = results[:q.limit]
+	}
+	return results
+}
+
+// queryTable returns a renderer of query blocks showing the documents
+// which the visitor can read as a table.
+func queryTable(documents map[string]document, v visitor) queryRenderer {
+	return func(text string) template.HTML {
+		q, err := parseQuery(text)
+		if err != nil {
+			return template.HTML(`<p class="query-error">Invalid query: ` + template.HTMLEscapeString(err.Error()) + `</p>`)
+		}
+		results := q.run(documents, v)
+		if len(results) == 0 {
+			return template.HTML(`<p class="query-empty">No notes match the query.</p>`)
+		}
+		html := template.HTML(`<table class="query"><thead><tr>`)
+		for _, column := range q.columns {
+			html += `<th>` + template.HTML(template.HTMLEscapeString(column)) + `</th>`
+		}
+		html += `</tr></thead><tbody>`
+		for _, doc := range results {
+			html += `<tr>`
+			for _, column := range q.columns {
+				if column == "title" {
+					title := doc.title
+					if title == "" {
+						title = doc.slug
+					}
+					html += `<td>` + fileLink(doc.slug, title) + `</td>`
+				} else {
+					html += `<td>` + template.HTML(template.HTMLEscapeString(queryValue(doc, column))) + `</td>`
+				}
+			}
+			html += `</tr>`
+		}
+		return html + `</tbody></table>`
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// reference describes a document which refers to a slug.
+type reference struct {
+	Id    string
+	Slug  string
+	Title string
+	Host  bool // The slug is the host of the document.
+	Link  bool // The document links to the slug.
+}
+
+// slug returns the slug of the document with the given id.
+func (idx *documentIndex) slug(id string) (slug string, ok bool) {
+	idx.RLock()
+	defer idx.RUnlock()
+	slug, ok = idx.slugs[id]
+	return
+}
+
+// file returns the indexed file with the given id.
+func (idx *documentIndex) file(id string) (f docFile, ok bool) {
+	idx.RLock()
+	defer idx.RUnlock()
+	f, ok = idx.files[id]
+	return
+}
+
+// references returns the documents, other than the one with the given id,
+// which have the slug as their host or link to it and which the visitor may edit.
+func (idx *documentIndex) references(slug, id string, v visitor) (refs []reference) {
+	idx.RLock()
+	defer idx.RUnlock()
+	doc, ok := idx.documents[slug]
+	if !ok {
+		return
+	}
+	found := make(map[string]int) // Indices in refs by slug
+	add := func(s string) *reference {
+		if i, ok := found[s]; ok {
+			return &refs[i]
+		}
+		d := idx.documents[s]
+		found[s] = len(refs)
+		refs = append(refs, reference{Id: d.id, Slug: s, Title: d.title})
+		return &refs[len(refs)-1]
+	}
+	for _, s := range doc.children {
+		if d := idx.documents[s]; d.id != "" && d.id != id && v.allowed(idx.documents, d, true) {
+			add(s).Host = true
+		}
+	}
+	for _, s := range doc.backlinks {
+		if d := idx.documents[s]; d.id != "" && d.id != id && v.allowed(idx.documents, d, true) {
+			add(s).Link = true
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Slug < refs[j].Slug })
+	return
+}
+
+// rewriteReferences replaces references to the slug from with to in the
+// body of a file. Both the host in the first line and the `{}` links
+// in the rest of the file are updated.
+func rewriteReferences(body, from, to string) string {
+	lines := strings.SplitN(rewriteHost(body, from, to), "\n", 2)
+	if len(lines) == 2 {
+		lines[1] = replaceLinks(lines[1], from, to)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// rewriteHost changes the host declared in the first line of the body
+// of a file, and the hosts in the `also-in` header, from from to to.
+func rewriteHost(body, from, to string) string {
+	lines := strings.Split(body, "\n")
+	head := strings.SplitN(lines[0], " ", 2)
+	hostSlug := strings.SplitN(head[0], ":", 2)
+	if len(hostSlug) == 2 && hostSlug[0] == from {
+		hostSlug[0] = to
+		head[0] = strings.Join(hostSlug, ":")
+		lines[0] = strings.Join(head, " ")
+	}
+	for i, line := range lines[1:] {
+		h := strings.SplitN(line, ":", 2)
+		if strings.TrimSpace(line) == "" || len(h) == 1 {
+			break // End of the headers
+		}
+		if strings.TrimSpace(h[0]) != "also-in" {
+			continue
+		}
+		hosts := headerList(h[1])
+		if !contains(hosts, from) {
+			continue
+		}
+		for j, host := range hosts {
+			if host == from {
+				hosts[j] = to
+			}
+		}
+		lines[i+1] = h[0] + ": " + strings.Join(hosts, ", ")
+	}
+	return strings.Join(lines, "\n")
+}
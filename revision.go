@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// When, by whom and why every revision was saved is recorded outside of the
+// document, in a file next to its history, so that it can't be changed by
+// editing the document. The current version is recorded under the generation
+// 0, and its entry is moved to the generation under which it's saved in the
+// history when it's replaced.
+
+// revisionRecord is the entry of a revision in the record of a document.
+type revisionRecord struct {
+	Generation uint64    `json:"generation"`
+	Hash       string    `json:"hash"` // Of the body, so that versions changed by other programs aren't described
+	Time       time.Time `json:"time"`
+	Author     string    `json:"author,omitempty"`
+	Summary    string    `json:"summary,omitempty"`
+}
+
+// revisionRecords is held while a document is written or removed and its record is updated.
+var revisionRecords sync.Mutex
+
+// recordPath returns the path of the record of the document. Files whose
+// names don't contain `@` are ignored in the history directory of the store.
+func recordPath(id string) string {
+	return filepath.Join(docs.Root, ".history", filepath.Clean("/"+id)) + ".revisions"
+}
+
+func bodyHash(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// readRecord returns the entries of the record of the document, which may be empty.
+func readRecord(id string) (record []revisionRecord) {
+	bytes, err := os.ReadFile(recordPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		panic(appError{Err: err, Description: "Failed to read the revisions of the document"})
+	}
+	if err := json.Unmarshal(bytes, &record); err != nil {
+		panic(appError{Err: err, Description: "Failed to parse the revisions of the document"})
+	}
+	return
+}
+
+func writeRecord(id string, record []revisionRecord) {
+	bytes, err := json.MarshalIndent(record, "", "\t")
+	if err != nil {
+		panic(err)
+	}
+	path := recordPath(id)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		panic(appError{Err: err, Description: "Failed to save the revisions of the document"})
+	}
+	if err := os.WriteFile(path, bytes, 0644); err != nil {
+		panic(appError{Err: err, Description: "Failed to save the revisions of the document"})
+	}
+}
+
+// archiveCurrent moves the entry of the current version to the newest generation in
+// the history, if the version was saved under it. Otherwise the entry is dropped.
+func archiveCurrent(id string, record []revisionRecord) (archived []revisionRecord) {
+	history, _ := docs.FileHistory(id)
+	for _, entry := range record {
+		if entry.Generation == 0 {
+			if len(history) == 0 || findRevision(record, history[0]) != nil {
+				continue // The version wasn't saved again
+			}
+			if body, ok := readRevision(id, history[0]); !ok || bodyHash(body) != entry.Hash {
+				continue // Changed by another program
+			}
+			entry.Generation = history[0]
+		}
+		archived = append(archived, entry)
+	}
+	return
+}
+
+// findRevision returns the entry of the generation, or nil if it has none.
+func findRevision(record []revisionRecord, generation uint64) *revisionRecord {
+	for i := range record {
+		if record[i].Generation == generation {
+			return &record[i]
+		}
+	}
+	return nil
+}
+
+// writeRevision writes the document and records the revision. The
+// author and summary are left out if empty.
+func writeRevision(f docFile, author, summary string) {
+	revisionRecords.Lock()
+	defer revisionRecords.Unlock()
+	writeDocument(f)
+	record := archiveCurrent(f.Id, readRecord(f.Id))
+	record = append(record, revisionRecord{
+		Hash:    bodyHash(f.Body),
+		Time:    time.Now().UTC(),
+		Author:  author,
+		Summary: strings.Join(strings.Fields(summary), " "),
+	})
+	writeRecord(f.Id, record)
+}
+
+// removeRevision removes the document from the store. The entry of its
+// last version is kept with the version in the history.
+func removeRevision(id string) {
+	revisionRecords.Lock()
+	defer revisionRecords.Unlock()
+	if err := docs.Remove(id); err != nil {
+		panic(appError{Err: err, Description: "Failed to delete document"})
+	}
+	if record := readRecord(id); len(record) != 0 {
+		writeRecord(id, archiveCurrent(id, record))
+	}
+}
+
+// revisionInfo describes a saved revision of a document.
+type revisionInfo struct {
+	Revision string // Generation number or "current"
+	Time     string // Empty if unknown
+	Author   string
+	Summary  string
+}
+
+// revisionInfos returns the recorded descriptions of the given revisions of a document.
+func revisionInfos(id string, revisions []string) []revisionInfo {
+	revisionRecords.Lock()
+	record := readRecord(id)
+	revisionRecords.Unlock()
+	infos := make([]revisionInfo, 0, len(revisions))
+	for _, revision := range revisions {
+		info := revisionInfo{Revision: revision}
+		generation, _ := strconv.ParseUint(revision, 10, 64)
+		entry := findRevision(record, generation)
+		if entry != nil && generation == 0 {
+			// The current version might have been changed by another program.
+			if body, ok := readRevision(id, 0); !ok || bodyHash(body) != entry.Hash {
+				entry = nil
+			}
+		}
+		if entry != nil {
+			info.Time = entry.Time.Local().Format("2006-01-02 15:04")
+			info.Author = entry.Author
+			info.Summary = entry.Summary
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/atmatto/atylar"
+)
+
+func useTemporaryStore(t *testing.T) {
+	store, err := atylar.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs = store
+	docIndex = newDocumentIndex(nil)
+}
+
+func TestRevisionRecord(t *testing.T) {
+	useTemporaryStore(t)
+	writeRevision(docFile{"a", ":a First\n\none"}, "alice", "Created")
+	writeRevision(docFile{"a", ":a First\n\ntwo"}, "bob", "  Second\n version ")
+	history, _ := docs.FileHistory("a")
+	if len(history) != 1 {
+		t.Fatalf("history %v", history)
+	}
+	first := strconv.FormatUint(history[0], 10)
+	infos := revisionInfos("a", []string{"current", first})
+	if infos[0].Author != "bob" || infos[0].Summary != "Second version" || infos[0].Time == "" {
+		t.Errorf("current: %+v", infos[0])
+	}
+	if infos[1].Author != "alice" || infos[1].Summary != "Created" {
+		t.Errorf("first: %+v", infos[1])
+	}
+	if doc, _ := docIndex.byId("a"); len(doc.headers) != 0 {
+		t.Errorf("headers %v", doc.headers)
+	}
+
+	// A version changed by another program isn't described.
+	if err := os.WriteFile(docs.Root+"/a", []byte(":a First\n\nthree"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if info := revisionInfos("a", []string{"current"})[0]; info.Author != "" || info.Time != "" {
+		t.Errorf("changed: %+v", info)
+	}
+	writeRevision(docFile{"a", ":a First\n\nfour"}, "carol", "")
+	history, _ = docs.FileHistory("a")
+	if info := revisionInfos("a", []string{strconv.FormatUint(history[0], 10)})[0]; info.Author != "" {
+		t.Errorf("changed after saving: %+v", info)
+	}
+
+	// The last version keeps its entry in the trash.
+	removeRevision("a")
+	history, _ = docs.FileHistory("a")
+	if info := revisionInfos("a", []string{strconv.FormatUint(history[0], 10)})[0]; info.Author != "carol" {
+		t.Errorf("removed: %+v", info)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A host document can declare headers for the documents below it with headers
+// of the form `field-NAME: TYPE`, optionally followed by `, required`. The types
+// are text, date (YYYY-MM-DD), number, list (separated by commas), link (slug of
+// an existing document) and enum(a|b|c). Declarations of nearer hosts take
+// precedence. The editor shows inputs for the declared headers and checks them.
+const schemaPrefix = "field-"
+
+const dateFormat = "2006-01-02"
+
+type schemaField struct {
+	Name     string
+	Type     string   // text, date, number, list, link or enum
+	Options  []string // Allowed values of an enum
+	Required bool
+}
+
+// formField is an input for a declared header shown in the editor.
+type formField struct {
+	schemaField
+	Value string
+	Error string
+}
+
+// parseSchemaField parses the declaration of a header. Unknown types are text.
+func parseSchemaField(name, declaration string) schemaField {
+	field := schemaField{Name: name, Type: "text"}
+	parts := headerList(declaration)
+	if len(parts) == 0 {
+		return field
+	}
+	for _, flag := range parts[1:] {
+		if strings.ToLower(flag) == "required" {
+			field.Required = true
+		}
+	}
+	typ := strings.ToLower(parts[0])
+	switch {
+	case typ == "date" || typ == "number" || typ == "list" || typ == "link":
+		field.Type = typ
+	case strings.HasPrefix(typ, "enum(") && strings.HasSuffix(typ, ")"):
+		for _, option := range strings.Split(parts[0][len("enum("):len(parts[0])-1], "|") {
+			if option = strings.TrimSpace(option); option != "" {
+				field.Options = append(field.Options, option)
+			}
+		}
+		if len(field.Options) != 0 {
+			field.Type = "enum"
+		}
+	}
+	return field
+}
+
+// documentSchema returns the headers declared for the documents
+// below the host with the given slug, sorted by name.
+func documentSchema(documents map[string]document, host string) (schema []schemaField) {
+	declared := make(map[string]bool)
+	visited := make(map[string]bool)
+	slug := host
+	for !visited[slug] {
+		visited[slug] = true
+		doc := documents[slug]
+		for key, value := range doc.headers {
+			name := strings.TrimPrefix(key, schemaPrefix)
+			if key == name || name == "" || declared[name] {
+				continue
+			}
+			declared[name] = true
+			schema = append(schema, parseSchemaField(name, value))
+		}
+		if slug == "" {
+			break // Root
+		}
+		slug = doc.host
+	}
+	sort.Slice(schema, func(i, j int) bool { return schema[i].Name < schema[j].Name })
+	return
+}
+
+// check returns a description of what is wrong with the value, or "".
+func (f schemaField) check(documents map[string]document, value string) string {
+	if value == "" {
+		if f.Required {
+			return "This field is required."
+		}
+		return ""
+	}
+	switch f.Type {
+	case "date":
+		if _, err := time.Parse(dateFormat, value); err != nil {
+			return "Expected a date like 2006-01-02."
+		}
+	case "number":
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return "Expected a number."
+		}
+	case "enum":
+		if !contains(f.Options, value) {
+			return "Expected one of: " + strings.Join(f.Options, ", ") + "."
+		}
+	case "list":
+		if len(headerList(value)) == 0 && f.Required {
+			return "This field is required."
+		}
+	case "link":
+		if d, ok := documents[value]; !ok || d.id == "" {
+			return "No note has the slug " + value + "."
+		}
+	}
+	return ""
+}
+
+// schemaFields returns the inputs for the headers declared for documents below
+// the host, filled with the values from the headers and checked if check is set.
+// The declared headers are removed from the map, which then contains the rest.
+func schemaFields(host string, headers map[string]string, check bool) (fields []formField, valid bool) {
+	docIndex.RLock()
+	defer docIndex.RUnlock()
+	valid = true
+	for _, f := range documentSchema(docIndex.documents, host) {
+		field := formField{schemaField: f, Value: headers[f.Name]}
+		delete(headers, f.Name)
+		if f.Type == "list" {
+			field.Value = strings.Join(headerList(field.Value), ", ")
+		}
+		if check {
+			field.Error = f.check(docIndex.documents, field.Value)
+			valid = valid && field.Error == ""
+		}
+		if f.Type == "enum" && field.Value != "" && !contains(f.Options, field.Value) {
+			// The invalid value can still be selected, so that it isn't lost.
+			field.Options = append(append([]string(nil), f.Options...), field.Value)
+		}
+		fields = append(fields, field)
+	}
+	return
+}
+
+// postedFields replaces the headers with the values of the inputs for
+// the declared headers which were sent with the request. Headers
+// with empty values are removed and lists are normalized. The inputs
+// shown in the form are used even if the host was changed and the
+// new host doesn't declare them, so that their values aren't lost.
+func postedFields(r *http.Request, host string, headers map[string]string) {
+	// The types come from the schemas of both hosts, the new one taking precedence.
+	hosts := []string{host}
+	if doc, ok := docIndex.byId(r.PostFormValue("Id")); ok && doc.host != host {
+		hosts = append(hosts, doc.host)
+	}
+	types := make(map[string]string)
+	docIndex.RLock()
+	for _, h := range hosts {
+		for _, f := range documentSchema(docIndex.documents, h) {
+			if types[f.Name] == "" {
+				types[f.Name] = f.Type
+			}
+		}
+	}
+	docIndex.RUnlock()
+	for key, values := range r.PostForm {
+		name := strings.TrimPrefix(key, "Field.")
+		if name == key || name == "" {
+			continue
+		}
+		value := strings.TrimSpace(values[0])
+		if types[name] == "list" {
+			value = strings.Join(headerList(value), ", ")
+		}
+		if value != "" {
+			headers[name] = value
+		} else {
+			delete(headers, name)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestChangingHostKeepsShownFields(t *testing.T) {
+	useTemporaryStore(t)
+	writeRevision(docFile{"old", ":old Old\nfield-status: enum(open|closed)\nfield-owners: list\n\n"}, "", "")
+	writeRevision(docFile{"new", ":new New\nfield-due: date\n\n"}, "", "")
+	writeRevision(docFile{"a", "old:a A\nstatus: open\nowners: x, y\n\n"}, "", "")
+
+	// The editor showed the fields of the old host, and the host was changed.
+	form := url.Values{
+		"Id": {"a"}, "Host": {"new"}, "Slug": {"a"}, "Title": {"A"}, "Headers": {"{}"}, "Body": {""},
+		"Field.status": {"closed"}, "Field.owners": {"x ,y"}, "Field.due": {"2024-01-02"},
+	}
+	r := httptest.NewRequest(http.MethodPost, "/edit/a", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	errorHandler(serveEditor()).ServeHTTP(w, r)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("saving: %d", w.Code)
+	}
+	doc, _ := docIndex.byId("a")
+	for name, value := range map[string]string{"status": "closed", "owners": "x, y", "due": "2024-01-02"} {
+		if doc.headers[name] != value {
+			t.Errorf("%s: %q, expected %q", name, doc.headers[name], value)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Weights of terms found in different parts of a document.
+const (
+	titleWeight   = 8
+	slugWeight    = 8
+	headerWeight  = 4
+	contentWeight = 1
+)
+
+const maxSearchResults = 50
+
+// invertedIndex maps terms to the documents in which they appear.
+type invertedIndex struct {
+	postings map[string]map[string]int // Scores of documents by id, by term
+	terms    map[string][]string       // Terms of documents by id
+}
+
+func newInvertedIndex() invertedIndex {
+	return invertedIndex{
+		postings: make(map[string]map[string]int),
+		terms:    make(map[string][]string),
+	}
+}
+
+// tokenize splits the text into lowercase words.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// add indexes the document with the given id.
+func (inv invertedIndex) add(id string, doc document) {
+	scores := make(map[string]int)
+	count := func(text string, weight int) {
+		for _, term := range tokenize(text) {
+			scores[term] += weight
+		}
+	}
+	count(doc.title, titleWeight)
+	count(doc.slug, slugWeight)
+	for k, v := range doc.headers {
+		count(k+" "+v, headerWeight)
+	}
+	count(doc.content, contentWeight)
+
+	terms := make([]string, 0, len(scores))
+	for term, score := range scores {
+		if inv.postings[term] == nil {
+			inv.postings[term] = make(map[string]int)
+		}
+		inv.postings[term][id] = score
+		terms = append(terms, term)
+	}
+	inv.terms[id] = terms
+}
+
+// remove removes the document with the given id from the index.
+func (inv invertedIndex) remove(id string) {
+	for _, term := range inv.terms[id] {
+		delete(inv.postings[term], id)
+		if len(inv.postings[term]) == 0 {
+			delete(inv.postings, term)
+		}
+	}
+	delete(inv.terms, id)
+}
+
+// lookup returns the ids of documents which contain all the terms,
+// together with their summed scores.
+func (inv invertedIndex) lookup(terms []string) map[string]int {
+	if len(terms) == 0 {
+		return nil
+	}
+	results := make(map[string]int)
+	for id, score := range inv.postings[terms[0]] {
+		results[id] = score
+	}
+	for _, term := range terms[1:] {
+		postings := inv.postings[term]
+		for id := range results {
+			if score, ok := postings[id]; ok {
+				results[id] += score
+			} else {
+				delete(results, id)
+			}
+		}
+	}
+	return results
+}
+
+type searchResult struct {
+	Slug    string
+	Title   string
+	Snippet template.HTML
+}
+
+// search returns documents matching the query, starting with the best ones.
+func (idx *documentIndex) search(query string, v visitor) (results []searchResult) {
+	terms := tokenize(query)
+	idx.RLock()
+	defer idx.RUnlock()
+	scores := idx.inverted.lookup(terms)
+
+	ids := make([]string, 0, len(scores))
+	for id := range scores {
+		if v.canRead(idx.documents, idx.slugs[id]) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if scores[ids[i]] != scores[ids[j]] {
+			return scores[ids[i]] > scores[ids[j]]
+		}
+		return idx.slugs[ids[i]] < idx.slugs[ids[j]]
+	})
+	if len(ids) > maxSearchResults {
+		ids = ids[:maxSearchResults]
+	}
+
+	for _, id := range ids {
+		doc := idx.documents[idx.slugs[id]]
+		title := doc.title
+		if title == "" {
+			title = doc.slug
+		}
+		results = append(results, searchResult{
+			Slug:    doc.slug,
+			Title:   title,
+			Snippet: highlight(parseDocument(snippet(doc.content, terms)), terms),
+		})
+	}
+	return
+}
+
+// snippet returns the line of the content which contains the most terms.
+func snippet(content string, terms []string) string {
+	best, bestCount := "", 0
+	for _, line := range strings.Split(content, "\n") {
+		words := make(map[string]bool)
+		for _, word := range tokenize(line) {
+			words[word] = true
+		}
+		count := 0
+		for _, term := range terms {
+			if words[term] {
+				count++
+			}
+		}
+		if count > bestCount {
+			best, bestCount = line, count
+		}
+	}
+	return best
+}
+
+// highlight wraps words of the HTML text which are equal to one of
+// the terms in <mark> elements. Tags and entities are left intact.
+func highlight(html template.HTML, terms []string) template.HTML {
+	match := make(map[string]bool, len(terms))
+	for _, term := range terms {
+		match[term] = true
+	}
+	isWordRune := func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r)
+	}
+
+	in := []rune(string(html))
+	var out strings.Builder
+	for i := 0; i < len(in); {
+		switch {
+		case in[i] == '<' || in[i] == '&': // Copy a tag or an entity
+			end := '>'
+			if in[i] == '&' {
+				end = ';'
+			}
+			j := i
+			for j < len(in) && in[j] != end {
+				j++
+			}
+			if j < len(in) {
+				j++
+			}
+			out.WriteString(string(in[i:j]))
+			i = j
+		case isWordRune(in[i]):
+			j := i
+			for j < len(in) && isWordRune(in[j]) {
+				j++
+			}
+			word := string(in[i:j])
+			if match[strings.ToLower(word)] {
+				out.WriteString("<mark>" + word + "</mark>")
+			} else {
+				out.WriteString(word)
+			}
+			i = j
+		default:
+			out.WriteRune(in[i])
+			i++
+		}
+	}
+	return template.HTML(out.String())
+}
+
+func serveSearch() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("q")
+		var results []searchResult
+		if strings.TrimSpace(query) != "" {
+			results = docIndex.search(query, requestVisitor(r))
+		}
+
+		var pageBuilder strings.Builder
+		err := templates.ExecuteTemplate(&pageBuilder, "search.html", struct {
+			Query   string
+			Results []searchResult
+		}{query, results})
+		if err != nil {
+			panic(appError{Err: err, Description: "Failed to generate search page"})
+		}
+		w.Write([]byte(createPage("Manesei (search)", template.HTML(pageBuilder.String()))))
+	})
+}
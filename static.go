@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// hrefPattern matches the link targets in the generated pages.
+var hrefPattern = regexp.MustCompile(`href="([^"]*)"`)
+
+// staticFileName returns the name of the file to which
+// the document with the given slug is exported.
+func staticFileName(slug string) string {
+	if slug == "" {
+		return "index.html"
+	}
+	name := strings.NewReplacer("/", "_", "\\", "_").Replace(slug)
+	if name == "index" {
+		name += "_" // Don't overwrite the root document
+	}
+	return name + ".html"
+}
+
+// staticLinks rewrites the links to documents in a page so
+// that they point to the exported files, relative to the page.
+func staticLinks(page string, documents map[string]document) string {
+	page = strings.ReplaceAll(page, "url('/fonts/", "url('fonts/")
+	return hrefPattern.ReplaceAllStringFunc(page, func(attribute string) string {
+		target := html.UnescapeString(hrefPattern.FindStringSubmatch(attribute)[1])
+		if target == appPath("/n/") {
+			target = ""
+		} else if strings.HasPrefix(target, "./") {
+			target = strings.TrimPrefix(target, "./")
+		}
+		if _, ok := documents[target]; !ok {
+			return attribute
+		}
+		return `href="` + html.EscapeString(staticFileName(target)) + `"`
+	})
+}
+
+// exportStatic writes every note as a standalone HTML page, so that
+// the notes can be published without running the server.
+func exportStatic(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: static DIRECTORY")
+	}
+	root := args[0]
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+	docIndex.RLock()
+	defer docIndex.RUnlock()
+	documents := docIndex.documents
+
+	// The website is public, so only the notes which anonymous visitors may read are exported.
+	var anonymous visitor
+	exported := make(map[string]document)
+	for slug, doc := range documents {
+		if anonymous.canRead(documents, slug) {
+			exported[slug] = doc
+		}
+	}
+	for slug, doc := range exported {
+		page := staticLinks(string(documentPage(documents, doc, anonymous, true)), exported)
+		if err := os.WriteFile(filepath.Join(root, staticFileName(slug)), []byte(page), 0644); err != nil {
+			return err
+		}
+	}
+
+	err := fs.WalkDir(fontsFS, "fonts", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(root, filepath.FromSlash(p))
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		data, err := fontsFS.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, 0644)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println("Exported", len(exported), "pages.")
+	return nil
+}
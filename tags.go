@@ -0,0 +1,172 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parseTags returns the tags listed in the value of the `tags` header, in
+// lowercase and without duplicates. The brackets of YAML lists, which may
+// come from imported front matter, are ignored.
+func parseTags(value string) (tags []string) {
+	value = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(value), "["), "]")
+	for _, tag := range headerList(value) {
+		tag = strings.ToLower(strings.Trim(tag, `#"'`))
+		if tag != "" && !contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return
+}
+
+// tagHref returns the escaped URL of the page listing the documents with the tag.
+func tagHref(tag string) string {
+	return template.HTMLEscapeString(appPath("/tag/" + url.PathEscape(tag)))
+}
+
+// tagsHTML returns the list of tags shown under the title of a document.
+// Static pages don't link to the tag pages, which aren't exported.
+func tagsHTML(tags []string, static bool) template.HTML {
+	if len(tags) == 0 {
+		return ""
+	}
+	html := template.HTML(`<ul class="tags">`)
+	for _, tag := range tags {
+		if static {
+			html += `<li>#` + template.HTML(template.HTMLEscapeString(tag)) + `</li>`
+		} else {
+			html += `<li><a href="` + template.HTML(tagHref(tag)) + `">#` + template.HTML(template.HTMLEscapeString(tag)) + `</a></li>`
+		}
+	}
+	return html + `</ul>`
+}
+
+// withTags inserts the tags under the heading with which the
+// content of a document starts, or before the content.
+func withTags(content template.HTML, tags []string, static bool) template.HTML {
+	list := tagsHTML(tags, static)
+	if list == "" {
+		return content
+	}
+	if strings.HasPrefix(string(content), "<h1>") {
+		if i := strings.Index(string(content), "</h1>"); i != -1 {
+			i += len("</h1>")
+			return content[:i] + list + content[i:]
+		}
+	}
+	return list + content
+}
+
+type tagCount struct {
+	Name  string
+	Count int
+}
+
+// tagCounts returns the tags of the documents which the visitor can read,
+// sorted by name, with the number of documents having them.
+func tagCounts(documents map[string]document, v visitor) []tagCount {
+	counts := make(map[string]int)
+	for slug, doc := range documents {
+		if doc.id != "" && v.canRead(documents, slug) {
+			for _, tag := range doc.tags {
+				counts[tag]++
+			}
+		}
+	}
+	tags := make([]tagCount, 0, len(counts))
+	for name, count := range counts {
+		tags = append(tags, tagCount{name, count})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	return tags
+}
+
+// tagCloudHTML returns the tags sized by the number of documents having them.
+func tagCloudHTML(tags []tagCount, static bool) template.HTML {
+	if len(tags) == 0 {
+		return ""
+	}
+	most := 2 // Avoids dividing by zero
+	for _, t := range tags {
+		if t.Count > most {
+			most = t.Count
+		}
+	}
+	html := template.HTML(`<p class="tag-cloud">`)
+	for _, t := range tags {
+		size := strconv.Itoa(100 + 80*(t.Count-1)/(most-1))
+		title := template.HTMLEscapeString(t.Name) + " (" + strconv.Itoa(t.Count) + ")"
+		if static {
+			html += template.HTML(`<span style="font-size: ` + size + `%" title="` + title + `">#` + template.HTMLEscapeString(t.Name) + `</span> `)
+		} else {
+			html += template.HTML(`<a style="font-size: ` + size + `%" title="` + title + `" href="` + tagHref(t.Name) + `">#` + template.HTMLEscapeString(t.Name) + `</a> `)
+		}
+	}
+	return html + `</p>`
+}
+
+type taggedDocument struct {
+	Slug      string
+	Title     string
+	HostSlug  string
+	HostTitle string
+}
+
+// tagged returns the documents with the tag which the visitor can read, sorted by title.
+func (idx *documentIndex) tagged(tag string, v visitor) (tagged []taggedDocument) {
+	idx.RLock()
+	defer idx.RUnlock()
+	for slug, doc := range idx.documents {
+		if doc.id == "" || !contains(doc.tags, tag) || !v.canRead(idx.documents, slug) {
+			continue
+		}
+		t := taggedDocument{Slug: slug, Title: doc.title}
+		if slug != "" && doc.host != "" && v.canRead(idx.documents, doc.host) {
+			t.HostSlug, t.HostTitle = doc.host, idx.documents[doc.host].title
+		}
+		tagged = append(tagged, t)
+	}
+	sort.Slice(tagged, func(i, j int) bool {
+		if tagged[i].Title != tagged[j].Title {
+			return tagged[i].Title < tagged[j].Title
+		}
+		return tagged[i].Slug < tagged[j].Slug
+	})
+	return
+}
+
+// serveTag lists the documents with a tag, or all tags. (/tag/name)
+func serveTag() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tag := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/tag/"))
+		v := requestVisitor(r)
+		var documents []taggedDocument
+		var cloud template.HTML
+		if tag != "" {
+			documents = docIndex.tagged(tag, v)
+		} else {
+			docIndex.RLock()
+			cloud = tagCloudHTML(tagCounts(docIndex.documents, v), false)
+			docIndex.RUnlock()
+		}
+
+		var pageBuilder strings.Builder
+		err := templates.ExecuteTemplate(&pageBuilder, "tag.html", struct {
+			Tag       string
+			Documents []taggedDocument
+			Cloud     template.HTML
+		}{tag, documents, cloud})
+		if err != nil {
+			panic(appError{Err: err, Description: "Failed to generate tag page"})
+		}
+		title := "Manesei (tags)"
+		if tag != "" {
+			title = "Manesei: #" + tag
+		}
+		w.Write([]byte(createPage(title, template.HTML(pageBuilder.String()))))
+	})
+}
@@ -1,2 +1,3 @@
 #!/bin/bash
-go build && ./manesei
+# Flags can be passed through, e.g. ./test.sh -listen :8080 -base /notes/
+go build && ./manesei "$@"
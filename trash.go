@@ -0,0 +1,157 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// deleteDocument removes the file with the given id from the store. Its
+// history is preserved, so it can be restored from the trash. If rehost
+// is true, the children of the document which the visitor can edit are
+// moved to its host, and the others are left under a placeholder, like all
+// children otherwise. The visitor is recorded as the author of the moves.
+func deleteDocument(id string, rehost bool, v visitor) {
+	if doc, ok := docIndex.byId(id); ok && rehost {
+		for _, ref := range docIndex.references(doc.slug, id, v) {
+			if !ref.Host {
+				continue
+			}
+			if f, ok := docIndex.file(ref.Id); ok {
+				body := rewriteHost(f.Body, doc.slug, doc.host)
+				writeRevision(docFile{Id: f.Id, Body: body}, v.user, "Moved out of deleted "+doc.slug)
+			}
+		}
+	}
+	removeRevision(id)
+	docIndex.remove(id)
+}
+
+// trashedDocument is a document which was deleted, but whose history still exists.
+type trashedDocument struct {
+	Id         string
+	Slug       string
+	Title      string
+	Generation uint64 // The last saved generation
+}
+
+// trashedDocuments returns deleted documents which the visitor
+// may read, starting with the most recently deleted.
+func trashedDocuments(v visitor) (trashed []trashedDocument) {
+	files, err := docs.List("/", true, true)
+	if err != nil {
+		panic(appError{Err: err, Description: "Failed to retrieve history list"})
+	}
+	latest := make(map[string]uint64)
+	for _, f := range files {
+		f = strings.TrimPrefix(f, "/")
+		i := strings.LastIndex(f, "@")
+		if i == -1 {
+			continue
+		}
+		generation, err := strconv.ParseUint(f[i+1:], 10, 64)
+		if err != nil {
+			continue
+		}
+		if id := f[:i]; generation > latest[id] {
+			latest[id] = generation
+		}
+	}
+	for id, generation := range latest {
+		if _, ok := docIndex.slug(id); ok {
+			continue // Not deleted
+		}
+		body, ok := readRevision(id, generation)
+		if !ok {
+			continue
+		}
+		doc := parseFile(docFile{id, body})
+		if !docIndex.allows(v, doc, false) {
+			continue
+		}
+		trashed = append(trashed, trashedDocument{id, doc.slug, doc.title, generation})
+	}
+	sort.Slice(trashed, func(i, j int) bool { return trashed[i].Generation > trashed[j].Generation })
+	return
+}
+
+// serveDelete asks for confirmation and deletes a document. (/delete/id)
+func serveDelete() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requireWritable()
+		id := strings.TrimPrefix(r.URL.Path, "/delete/")
+		doc, ok := docIndex.byId(id)
+		if !ok {
+			panic(appError{Description: "Note with given ID does not exist: " + id, Status: http.StatusNotFound})
+		}
+		requireAccess(r, id, true)
+		switch r.Method {
+		case http.MethodGet:
+			var children []reference
+			for _, ref := range docIndex.references(doc.slug, id, requestVisitor(r)) {
+				if ref.Host {
+					children = append(children, ref)
+				}
+			}
+			host := "🌱"
+			if doc.host != "" {
+				host = doc.host
+			}
+			var pageBuilder strings.Builder
+			err := templates.ExecuteTemplate(&pageBuilder, "delete.html", struct {
+				Id       string
+				Slug     string
+				Title    string
+				Host     string
+				Children []reference
+			}{id, doc.slug, doc.title, host, children})
+			if err != nil {
+				panic(appError{Err: err, Description: "Failed to generate delete page"})
+			}
+			w.Write([]byte(createPage("Manesei (delete)", template.HTML(pageBuilder.String()))))
+		case http.MethodPost:
+			deleteDocument(id, r.PostFormValue("Children") == "rehost", requestVisitor(r))
+			w.Header().Set("Location", appPath("/n/"+doc.host))
+			w.WriteHeader(http.StatusSeeOther)
+		default:
+			panic(appError{Description: "Unsupported HTTP method"})
+		}
+	})
+}
+
+// serveTrash lists deleted documents (/trash/) and restores them (POST /trash/id).
+func serveTrash() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/trash/")
+		switch r.Method {
+		case http.MethodGet:
+			var pageBuilder strings.Builder
+			err := templates.ExecuteTemplate(&pageBuilder, "trash.html", trashedDocuments(requestVisitor(r)))
+			if err != nil {
+				panic(appError{Err: err, Description: "Failed to generate trash page"})
+			}
+			w.Write([]byte(createPage("Manesei (trash)", template.HTML(pageBuilder.String()))))
+		case http.MethodPost:
+			requireWritable()
+			requireAccess(r, id, true)
+			if _, ok := docIndex.slug(id); ok || documentExists(id) {
+				panic(appError{Description: "Note is not deleted: " + id, Status: http.StatusConflict})
+			}
+			history, err := docs.FileHistory(id)
+			if err != nil || len(history) == 0 {
+				panic(appError{Err: err, Description: "Note with given ID is not in the trash: " + id, Status: http.StatusNotFound})
+			}
+			body, ok := readRevision(id, history[0])
+			if !ok {
+				panic(appError{Description: "Failed to read the last revision", Status: http.StatusNotFound})
+			}
+			writeRevision(docFile{Id: id, Body: body}, requestUser(r), "Restored from the trash")
+			w.Header().Set("Location", appPath("/nid/"+id))
+			w.WriteHeader(http.StatusSeeOther)
+		default:
+			panic(appError{Description: "Unsupported HTTP method"})
+		}
+	})
+}